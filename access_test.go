@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessRules(t *testing.T) {
+	b := newBackend("ok")
+	defer b.Close()
+
+	defer func(upstreams, regionCIDRs []string, access []cmd.AccessConfig) {
+		cmd.Upstreams, cmd.RegionCIDRs, cmd.AccessConfigs = upstreams, regionCIDRs, access
+	}(cmd.Upstreams, cmd.RegionCIDRs, cmd.AccessConfigs)
+	cmd.Upstreams = []string{b.URL, b.URL, b.URL}
+	cmd.RegionCIDRs = []string{"10.0.0.0/8=1", "20.0.0.0/8=2", "30.0.0.0/8=3"}
+	cmd.AccessConfigs = []cmd.AccessConfig{
+		{Action: "deny", Regions: []int{3}, Response: cmd.AccessResponse{Status: 451, Body: "<h1>Unavailable</h1>", ContentType: "text/html"}},
+		{Action: "allow", Regions: []int{2}, Paths: []string{"/public"}},
+		{Action: "deny", Regions: []int{2}, Response: cmd.AccessResponse{Redirect: "https://example.com/blocked"}},
+		{Action: "deny", CIDRs: []string{"10.1.0.0/16"}},
+		{Action: "deny", Regions: []int{1}, Paths: []string{"/admin/"}},
+	}
+	proxy := cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{}))
+
+	cases := []struct {
+		xff, path string
+		code      int
+		body      string
+	}{
+		{"10.0.0.1", "/", 200, "ok"},
+		{"10.1.0.1", "/", 403, "Forbidden\n"},
+		{"20.0.0.1", "/public/index.html", 200, "ok"},
+		{"20.0.0.1", "/private", 302, ""},
+		{"30.0.0.1", "/public", 451, "<h1>Unavailable</h1>"},
+		{"10.0.0.1", "/admin", 403, ""},
+		{"10.0.0.1", "//admin/x", 403, ""},
+		{"10.0.0.1", "/./admin", 403, ""},
+		{"10.0.0.1", "/administrator", 200, "ok"},
+	}
+	for _, c := range cases {
+		req := prepareRequest(t, "/", 1)
+		req.URL.Path = c.path
+		req.Header.Set("X-Forwarded-For", c.xff)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		assert.Equal(t, c.code, w.Code, c.xff+c.path)
+		if c.body != "" {
+			body, _ := ioutil.ReadAll(w.Body)
+			assert.Equal(t, c.body, string(body), c.xff+c.path)
+		}
+		if c.code == 302 {
+			assert.Equal(t, "https://example.com/blocked", w.Header().Get("Location"))
+		}
+		if c.code == 451 {
+			assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+		}
+	}
+	assert.Equal(t, "1", expvar.Get("access").(*expvar.Map).Get("region.3.blocked").String())
+
+	cmd.AccessConfigs = []cmd.AccessConfig{{Action: "block"}}
+	_, err := cmd.NewRouting(&cmd.Env{})
+	assert.NotNil(t, err)
+}
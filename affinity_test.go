@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAffinityCookie(t *testing.T) {
+	b1, b2 := newBackend("1"), newBackend("2")
+	defer b1.Close()
+	defer b2.Close()
+
+	defer func(upstreams, regionCIDRs []string, affinityCookie string, affinityKeys []string) {
+		cmd.Upstreams, cmd.RegionCIDRs = upstreams, regionCIDRs
+		cmd.AffinityCookie, cmd.AffinityKeys = affinityCookie, affinityKeys
+	}(cmd.Upstreams, cmd.RegionCIDRs, cmd.AffinityCookie, cmd.AffinityKeys)
+	cmd.Upstreams = []string{b1.URL, b2.URL}
+	cmd.RegionCIDRs = []string{"10.0.0.0/8=1", "20.0.0.0/8=2"}
+	cmd.AffinityCookie = "regiond"
+	cmd.AffinityKeys = []string{"old"}
+	newProxy := func() http.Handler {
+		return cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{}))
+	}
+	proxy := newProxy()
+
+	get := func(xff string, cookie *http.Cookie) (string, *http.Cookie) {
+		req := prepareRequest(t, "/", 1)
+		req.Header.Set("X-Forwarded-For", xff)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		var set *http.Cookie
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			set = cookies[0]
+		}
+		return string(body), set
+	}
+
+	body, cookie := get("10.0.0.1", nil)
+	assert.Equal(t, "1", body)
+	assert.NotNil(t, cookie)
+	assert.Equal(t, "regiond", cookie.Name)
+	assert.True(t, cookie.HttpOnly)
+
+	// Client keeps its upstream when its address is changed
+	body, set := get("20.0.0.1", cookie)
+	assert.Equal(t, "1", body)
+	assert.Nil(t, set)
+
+	// Tampered cookie is ignored
+	tampered := *cookie
+	tampered.Value = "x" + cookie.Value[1:]
+	body, set = get("20.0.0.1", &tampered)
+	assert.Equal(t, "2", body)
+	assert.NotNil(t, set)
+
+	// Cookies signed by old key are accepted after rotation, new ones are signed by new key
+	cmd.AffinityKeys = []string{"new", "old"}
+	proxy = newProxy()
+	body, _ = get("20.0.0.1", cookie)
+	assert.Equal(t, "1", body)
+	_, rotated := get("20.0.0.1", nil)
+	cmd.AffinityKeys = []string{"new"}
+	proxy = newProxy()
+	body, _ = get("20.0.0.1", cookie)
+	assert.Equal(t, "2", body)
+	body, _ = get("10.0.0.1", rotated)
+	assert.Equal(t, "2", body)
+
+	// Cookie of upstream removed from region is ignored
+	cmd.Upstreams = []string{b2.URL, b2.URL}
+	proxy = newProxy()
+	_, cookie = get("10.0.0.1", nil)
+	cmd.Upstreams = []string{b1.URL, b2.URL}
+	proxy = newProxy()
+	body, _ = get("20.0.0.1", cookie)
+	assert.Equal(t, "2", body)
+	body, _ = get("10.0.0.1", cookie)
+	assert.Equal(t, "1", body)
+}
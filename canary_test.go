@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanarySplit(t *testing.T) {
+	stable, canary := newBackend("stable"), newBackend("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs = upstreams, pools, regions
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"stable": {Upstreams: []string{stable.URL}},
+		"canary": {Upstreams: []string{canary.URL}},
+	}
+	cmd.RegionConfigs = []cmd.RegionConfig{{ID: 1, Pool: "stable", Splits: []cmd.SplitConfig{{Pool: "canary", Percent: 20}}}}
+
+	blt, err := bolt.Open("/tmp/regiond-canary.db", 0600, nil)
+	assert.Nil(t, err)
+	defer func() {
+		blt.Close()
+		os.Remove("/tmp/regiond-canary.db")
+	}()
+	p := cmd.NewMultipleHostProxy(&cmd.Env{Blt: blt})
+	proxy := cmd.NewXffProxy(p)
+
+	get := func(i int) string {
+		req := prepareRequest(t, "/", 1)
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		return string(body)
+	}
+	const clients = 2000
+	split := func() map[int]string {
+		pools := make(map[int]string)
+		for i := 0; i < clients; i++ {
+			pools[i] = get(i)
+		}
+		return pools
+	}
+
+	// Share of canary clients is close to split percent and clients keep their pools
+	first := split()
+	canaries := 0
+	for i, pool := range first {
+		if pool == "canary" {
+			canaries++
+		}
+		assert.Equal(t, pool, get(i))
+	}
+	assert.InDelta(t, clients/5, canaries, clients/20)
+	assert.NotNil(t, expvar.Get("canary").(*expvar.Map).Get("region.1.canary"))
+
+	// Splits are changed at runtime by admin API, cached clients follow them
+	admin := httptest.NewServer(cmd.NewAdminHandler(p))
+	defer admin.Close()
+	req, _ := http.NewRequest("PUT", admin.URL+"/canary?region=1", strings.NewReader(`[{"pool": "canary", "percent": 50}]`))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	var splits map[string][]cmd.SplitConfig
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&splits))
+	assert.Equal(t, []cmd.SplitConfig{{Pool: "canary", Percent: 50}}, splits["1"])
+
+	second := split()
+	canaries = 0
+	for i, pool := range second {
+		if pool == "canary" {
+			canaries++
+		}
+		// Growing canary share keeps existing canary clients
+		if first[i] == "canary" {
+			assert.Equal(t, "canary", pool)
+		}
+	}
+	assert.InDelta(t, clients/2, canaries, clients/20)
+
+	req, _ = http.NewRequest("PUT", admin.URL+"/canary?region=1", strings.NewReader(`[{"pool": "unknown", "percent": 50}]`))
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+}
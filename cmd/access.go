@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	pathpkg "path"
+	"strconv"
+	"strings"
+)
+
+var accessStats = expvar.NewMap("access")
+
+// ACL holds access rules, the first rule matching request decides if it is allowed.
+// Requests matching no rule are allowed.
+type ACL []accessRule
+
+type accessRule struct {
+	allow    bool
+	regions  map[int]bool
+	networks Networks
+	paths    []string
+	response AccessResponse
+}
+
+// AccessResponse is sent to denied clients and clients of regions in maintenance. Client is redirected if Redirect is set.
+type AccessResponse struct {
+	Status      int    `mapstructure:"status" yaml:",omitempty" json:"status,omitempty"`
+	Body        string `mapstructure:"body" yaml:",omitempty" json:"body,omitempty"`
+	ContentType string `mapstructure:"content-type" yaml:"content-type,omitempty" json:"content-type,omitempty"`
+	Redirect    string `mapstructure:"redirect" yaml:",omitempty" json:"redirect,omitempty"`
+}
+
+// NewACL creates access rules from config
+func NewACL(configs []AccessConfig) (ACL, error) {
+	var acl ACL
+	for i, c := range configs {
+		rule := accessRule{
+			regions:  make(map[int]bool),
+			response: c.Response,
+		}
+		switch c.Action {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("access rule %d: unknown action '%s'", i+1, c.Action)
+		}
+		for _, region := range c.Regions {
+			rule.regions[region] = true
+		}
+		var err error
+		if rule.networks, err = ParseNetworks(c.CIDRs); err != nil {
+			return nil, fmt.Errorf("access rule %d: %v", i+1, err)
+		}
+		for _, path := range c.Paths {
+			if !strings.HasPrefix(path, "/") {
+				return nil, fmt.Errorf("access rule %d: path must start with '/'", i+1)
+			}
+			rule.paths = append(rule.paths, strings.TrimSuffix(pathpkg.Clean(path), "/"))
+		}
+		if rule.response.Status == 0 {
+			rule.response.Status = http.StatusForbidden
+			if rule.response.Redirect != "" {
+				rule.response.Status = http.StatusFound
+			}
+		}
+		acl = append(acl, rule)
+	}
+	return acl, nil
+}
+
+// Check returns response for denied request of client IP routed to region, or nil if request is allowed
+func (acl ACL) Check(region int, ip string, path string) *AccessResponse {
+	for _, rule := range acl {
+		if !rule.matches(region, ip, path) {
+			continue
+		}
+		if rule.allow {
+			return nil
+		}
+		accessStats.Add("blocked", 1)
+		accessStats.Add("region."+strconv.Itoa(region)+".blocked", 1)
+		log.Printf("[%s] - Access to %s from region %d is denied\n", ip, path, region)
+		return &rule.response
+	}
+	return nil
+}
+
+// Rule matches request if every condition specified in rule is met
+func (rule accessRule) matches(region int, ip string, path string) bool {
+	if len(rule.regions) > 0 && !rule.regions[region] {
+		return false
+	}
+	if len(rule.networks) > 0 && !rule.networks.Contains(net.ParseIP(ip)) {
+		return false
+	}
+	if len(rule.paths) == 0 {
+		return true
+	}
+	// Cleaned path can't bypass rule by '//admin' or '/./admin'
+	path = pathpkg.Clean("/" + path)
+	for _, prefix := range rule.paths {
+		if hasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (resp *AccessResponse) serve(w http.ResponseWriter, req *http.Request) {
+	if resp.Redirect != "" {
+		http.Redirect(w, req, resp.Redirect, resp.Status)
+		return
+	}
+	body := resp.Body
+	if body == "" {
+		body = http.StatusText(resp.Status) + "\n"
+	}
+	contentType := resp.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(resp.Status)
+	w.Write([]byte(body))
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// AdminAddr is address admin API listens on, it is disabled if empty
+var AdminAddr string
+
+// NewAdminHandler creates admin API of proxy. Changes made by admin API are
+// valid until config reload.
+func NewAdminHandler(p *Proxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/canary", p.serveCanary)
+	mux.HandleFunc("/maintenance", p.serveMaintenance)
+	return mux
+}
+
+// Serves canary splits of regions. GET returns splits of all regions,
+// PUT replaces splits of region from 'region' query parameter, e.g.
+// curl -X PUT 'localhost:9091/canary?region=2' -d '[{"pool": "canary", "percent": 5}]'.
+// Splits of virtual route are managed with 'route' query parameter.
+func (p *Proxy) serveCanary(w http.ResponseWriter, req *http.Request) {
+	routing, err := p.routing.Load().route(req.URL.Query().Get("route"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		region, err := strconv.Atoi(req.URL.Query().Get("region"))
+		if err != nil {
+			http.Error(w, "region is not specified", http.StatusBadRequest)
+			return
+		}
+		var splits []SplitConfig
+		if err := json.NewDecoder(req.Body).Decode(&splits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := routing.SetSplits(region, splits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routing.Splits())
+}
+
+// Returns virtual route by name, default routing is returned for empty name
+func (r *Routing) route(name string) (*Routing, error) {
+	if name == "" {
+		return r, nil
+	}
+	for _, route := range r.Routes {
+		if route.Name == name {
+			return route, nil
+		}
+	}
+	return nil, fmt.Errorf("route '%s' is not found", name)
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// AffinityCookie is name of signed cookie which keeps client upstream, affinity cookie is disabled if empty
+	AffinityCookie string
+	// AffinityKeys holds HMAC keys of affinity cookie, the first one signs new cookies and all of them verify
+	AffinityKeys  []string
+	affinityStats = expvar.NewMap("affinity")
+)
+
+// Affinity keeps client upstream in signed expiring cookie, so client keeps it
+// when its address is changed or it is served by another proxy replica
+type Affinity struct {
+	Cookie string
+	Keys   [][]byte
+}
+
+type affinityClaims struct {
+	Route   string `json:"route,omitempty"`
+	Region  int    `json:"region"`
+	Pool    string `json:"pool"`
+	Target  string `json:"target"`
+	Expires int64  `json:"exp"`
+}
+
+// NewAffinity creates affinity from flags. Returns nil if affinity cookie is disabled.
+func NewAffinity() (*Affinity, error) {
+	if AffinityCookie == "" {
+		return nil, nil
+	}
+	a := &Affinity{Cookie: AffinityCookie}
+	for _, key := range AffinityKeys {
+		if key != "" {
+			a.Keys = append(a.Keys, []byte(key))
+		}
+	}
+	if len(a.Keys) == 0 {
+		return nil, fmt.Errorf("affinity cookie requires signing key")
+	}
+	return a, nil
+}
+
+// Upstream returns upstream from affinity cookie of request. Returns nil if cookie is absent, invalid,
+// expired, issued for another route, or its upstream doesn't serve the region anymore.
+func (a *Affinity) Upstream(req *http.Request, routing *Routing) *Upstream {
+	if a == nil {
+		return nil
+	}
+	c, err := req.Cookie(a.Cookie)
+	if err != nil {
+		return nil
+	}
+	claims, err := a.verify(c.Value)
+	if err == nil && claims.Route != routing.Name {
+		err = fmt.Errorf("cookie is issued for another route")
+	}
+	var target *url.URL
+	if err == nil {
+		if target, err = url.Parse(claims.Target); err == nil && !routing.serves(claims.Region, claims.Pool, target) {
+			err = fmt.Errorf("upstream doesn't serve region %d anymore", claims.Region)
+		}
+	}
+	if err != nil {
+		affinityStats.Add("invalid", 1)
+		return nil
+	}
+	affinityStats.Add("hit", 1)
+	return &Upstream{
+		Target:    *target,
+		Region:    claims.Region,
+		Pool:      claims.Pool,
+		Timestamp: time.Unix(claims.Expires, 0).Add(-time.Duration(routing.TTL) * time.Second),
+	}
+}
+
+// SetCookie adds affinity cookie for upstream which expires in routing TTL
+func (a *Affinity) SetCookie(w http.ResponseWriter, req *http.Request, routing *Routing, u *Upstream) {
+	if a == nil {
+		return
+	}
+	claims := affinityClaims{
+		Route:   routing.Name,
+		Region:  u.Region,
+		Pool:    u.Pool,
+		Target:  u.Target.String(),
+		Expires: time.Now().Add(time.Duration(routing.TTL) * time.Second).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return
+	}
+	value := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.Cookie,
+		Value:    value + "." + base64.RawURLEncoding.EncodeToString(sign(a.Keys[0], value)),
+		Path:     "/",
+		MaxAge:   int(routing.TTL),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	affinityStats.Add("set", 1)
+}
+
+// Verifies cookie signature by any of keys and its expiration
+func (a *Affinity) verify(value string) (*affinityClaims, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid cookie")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cookie signature")
+	}
+	valid := false
+	for _, key := range a.Keys {
+		valid = valid || hmac.Equal(sig, sign(key, value[:i]))
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid cookie signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return nil, err
+	}
+	var claims affinityClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > claims.Expires {
+		return nil, fmt.Errorf("cookie is expired")
+	}
+	return &claims, nil
+}
+
+func sign(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// Checks that upstream belongs to the pool which serves region directly or by split
+func (r *Routing) serves(region int, pool string, target *url.URL) bool {
+	p, ok := r.Pools[pool]
+	if !ok {
+		return false
+	}
+	served := r.Regions[region] == p
+	r.splitsMu.RLock()
+	for _, s := range r.splits[region] {
+		served = served || s.Pool == p
+	}
+	r.splitsMu.RUnlock()
+	if !served {
+		return false
+	}
+	for _, t := range p.Targets() {
+		if t.String() == target.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+)
+
+var canaryStats = expvar.NewMap("canary")
+
+// Split sends percent of region clients to pool
+type Split struct {
+	Pool    *Pool
+	Percent float64
+}
+
+// Creates splits of region from config
+func (r *Routing) newSplits(region int, configs []SplitConfig) ([]Split, error) {
+	var splits []Split
+	total := 0.0
+	for _, c := range configs {
+		pool, ok := r.Pools[c.Pool]
+		if !ok {
+			return nil, fmt.Errorf("region %d: split: unknown pool '%s'", region, c.Pool)
+		}
+		if c.Percent < 0 {
+			return nil, fmt.Errorf("region %d: split: negative percent", region)
+		}
+		total += c.Percent
+		splits = append(splits, Split{Pool: pool, Percent: c.Percent})
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("region %d: splits exceed 100 percent", region)
+	}
+	return splits, nil
+}
+
+// SetSplits replaces splits of region, empty splits send all clients to region pool.
+// Cached clients which are moved to another pool by new splits are rerouted.
+func (r *Routing) SetSplits(region int, configs []SplitConfig) error {
+	if _, ok := r.Regions[region]; !ok {
+		return fmt.Errorf("region %d is not found", region)
+	}
+	splits, err := r.newSplits(region, configs)
+	if err != nil {
+		return err
+	}
+	r.splitsMu.Lock()
+	defer r.splitsMu.Unlock()
+	if len(splits) == 0 {
+		delete(r.splits, region)
+	} else {
+		r.splits[region] = splits
+	}
+	return nil
+}
+
+// Splits returns current splits of regions
+func (r *Routing) Splits() map[int][]SplitConfig {
+	r.splitsMu.RLock()
+	defer r.splitsMu.RUnlock()
+	configs := make(map[int][]SplitConfig)
+	for region, splits := range r.splits {
+		for _, s := range splits {
+			configs[region] = append(configs[region], SplitConfig{Pool: s.Pool.Name, Percent: s.Percent})
+		}
+	}
+	return configs
+}
+
+// Pool returns pool of region for client. Client is sent to split pool if its bucket
+// falls into split share, so the same client always gets the same pool while splits are unchanged.
+func (r *Routing) Pool(region int, key string) *Pool {
+	pool, ok := r.Regions[region]
+	if !ok {
+		return nil
+	}
+	r.splitsMu.RLock()
+	defer r.splitsMu.RUnlock()
+	splits := r.splits[region]
+	if len(splits) == 0 {
+		return pool
+	}
+	bucket := clientBucket(region, key)
+	share := 0.0
+	for _, s := range splits {
+		share += s.Percent
+		if bucket < share {
+			return s.Pool
+		}
+	}
+	return pool
+}
+
+// Counts request to region pool if region has splits
+func (r *Routing) countSplit(u *Upstream) {
+	r.splitsMu.RLock()
+	_, ok := r.splits[u.Region]
+	r.splitsMu.RUnlock()
+	if ok {
+		canaryStats.Add("region."+strconv.Itoa(u.Region)+"."+u.Pool, 1)
+	}
+}
+
+// Returns stable bucket of client in range [0, 100) with 0.01 precision
+func clientBucket(region int, key string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(region) + "/" + key))
+	return float64(h.Sum32()%10000) / 100
+}
@@ -0,0 +1,436 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// PoolConfig describes named group of interchangeable upstreams. Upstreams are either listed explicitly
+// or discovered by DNS SRV name, Consul service or etcd key prefix.
+type PoolConfig struct {
+	Upstreams []string `mapstructure:"upstreams"`
+	// SRV is in form of '[scheme://]_service._proto.name[/base][?option=value]'
+	SRV string `mapstructure:"srv" yaml:",omitempty"`
+	// Consul is in form of '[scheme://]service[/base][?tag=name&option=value]'
+	Consul string `mapstructure:"consul" yaml:",omitempty"`
+	// Etcd is key prefix which values are upstreams
+	Etcd string `mapstructure:"etcd" yaml:",omitempty"`
+}
+
+// RegionConfig describes region with its pool, client networks, limits and canary splits
+type RegionConfig struct {
+	ID     int           `mapstructure:"id"`
+	Pool   string        `mapstructure:"pool"`
+	CIDRs  []string      `mapstructure:"cidrs"`
+	Limit  string        `mapstructure:"limit"`
+	Splits []SplitConfig `mapstructure:"splits" yaml:",omitempty"`
+	Mirror *MirrorConfig `mapstructure:"mirror" yaml:",omitempty"`
+	// Redirect sends region clients to region base URL instead of proxying
+	Redirect *RedirectConfig `mapstructure:"redirect" yaml:",omitempty"`
+	// Failover regions are tried in order, then default region, if region has no available upstreams
+	Failover []int `mapstructure:"failover" yaml:",omitempty"`
+	// Identities are JWT claim values or API key digests of region clients
+	Identities []string `mapstructure:"identities" yaml:",omitempty"`
+	// Headers are rewritten for region clients after global and route rules
+	Headers *HeadersConfig `mapstructure:"headers" yaml:",omitempty"`
+	// Records are answered by GeoDNS to region clients in form of 'name type value', e.g. 'www A 192.0.2.1'
+	Records []string `mapstructure:"records" yaml:",omitempty"`
+}
+
+// MirrorConfig duplicates percent of region requests to shadow pool
+type MirrorConfig struct {
+	Pool    string  `mapstructure:"pool"`
+	Percent float64 `mapstructure:"percent"`
+}
+
+// RedirectConfig redirects requests of region clients with matching path prefix and method to base URL
+// preserving path and query. Status is 302 by default, methods are GET and HEAD by default.
+type RedirectConfig struct {
+	URL     string   `mapstructure:"url"`
+	Status  int      `mapstructure:"status" yaml:",omitempty"`
+	Paths   []string `mapstructure:"paths" yaml:",omitempty"`
+	Methods []string `mapstructure:"methods" yaml:",omitempty"`
+}
+
+// SplitConfig sends percent of region clients to pool, e.g. canary one
+type SplitConfig struct {
+	Pool    string  `mapstructure:"pool" json:"pool"`
+	Percent float64 `mapstructure:"percent" json:"percent"`
+}
+
+// ResolverConfig describes region resolver. Type is either 'static' (CIDRs from
+// regions section and --regions flag) or 'oracle' (query to Oracle database).
+type ResolverConfig struct {
+	Type  string `mapstructure:"type"`
+	Query string `mapstructure:"query"`
+}
+
+// RouteConfig describes virtual host and path prefix with its own regions, resolvers and TTL.
+// Host may be wildcard in form of '*.domain'. Regions refer to pools from pools section.
+type RouteConfig struct {
+	Name          string           `mapstructure:"name"`
+	Host          string           `mapstructure:"host" yaml:",omitempty"`
+	Path          string           `mapstructure:"path" yaml:",omitempty"`
+	TTL           int64            `mapstructure:"ttl" yaml:",omitempty"`
+	DefaultRegion int              `mapstructure:"default-region" yaml:"default-region,omitempty"`
+	Regions       []RegionConfig   `mapstructure:"regions"`
+	Resolvers     []ResolverConfig `mapstructure:"resolvers" yaml:",omitempty"`
+	Headers       *HeadersConfig   `mapstructure:"headers" yaml:",omitempty"`
+	// MaxBodySize overrides --max-body-size for route, negative means no limit
+	MaxBodySize int64 `mapstructure:"max-body-size" yaml:"max-body-size,omitempty"`
+}
+
+// HeadersConfig rewrites request headers before forwarding to upstream and response headers before
+// responding to client
+type HeadersConfig struct {
+	Request  HeaderRules `mapstructure:"request" yaml:",omitempty"`
+	Response HeaderRules `mapstructure:"response" yaml:",omitempty"`
+}
+
+// HeaderRules removes, sets and adds headers in this order. Values may contain placeholders
+// {client-ip}, {region}, {upstream}, {pool} and {route}.
+type HeaderRules struct {
+	Remove []string          `mapstructure:"remove" yaml:",omitempty"`
+	Set    map[string]string `mapstructure:"set" yaml:",omitempty"`
+	Add    map[string]string `mapstructure:"add" yaml:",omitempty"`
+}
+
+// AccessConfig describes access rule. Action is either 'allow' or 'deny', rule matches request
+// if its region, client IP and path prefix match every condition specified in rule.
+type AccessConfig struct {
+	Action   string         `mapstructure:"action"`
+	Regions  []int          `mapstructure:"regions" yaml:",omitempty"`
+	CIDRs    []string       `mapstructure:"cidrs" yaml:",omitempty"`
+	Paths    []string       `mapstructure:"paths" yaml:",omitempty"`
+	Response AccessResponse `mapstructure:"response" yaml:",omitempty"`
+}
+
+// MaintenanceConfig puts region or single upstream of route into maintenance. Clients get maintenance
+// response with Retry-After or are sent to fallback region for the duration of maintenance.
+type MaintenanceConfig struct {
+	Route          string         `mapstructure:"route" yaml:",omitempty" json:"route,omitempty"`
+	Region         int            `mapstructure:"region" yaml:",omitempty" json:"region,omitempty"`
+	Upstream       string         `mapstructure:"upstream" yaml:",omitempty" json:"upstream,omitempty"`
+	RetryAfter     int            `mapstructure:"retry-after" yaml:"retry-after,omitempty" json:"retry-after,omitempty"`
+	FallbackRegion int            `mapstructure:"fallback-region" yaml:"fallback-region,omitempty" json:"fallback-region,omitempty"`
+	Response       AccessResponse `mapstructure:"response" yaml:",omitempty" json:"response"`
+}
+
+var (
+	// Pools holds named upstream pools from config file
+	Pools map[string]PoolConfig
+	// RegionConfigs holds regions from config file
+	RegionConfigs []RegionConfig
+	// ResolverConfigs holds resolvers from config file, they are tried in order until region is found
+	ResolverConfigs []ResolverConfig
+	// RouteConfigs holds virtual routes from config file
+	RouteConfigs []RouteConfig
+	// AccessConfigs holds access rules from config file
+	AccessConfigs []AccessConfig
+	// MaintenanceConfigs holds regions and upstreams in maintenance from config file
+	MaintenanceConfigs []MaintenanceConfig
+)
+
+// ApplyConfig sets flags which are not specified on command line from environment variables
+// and config file, then loads structured sections from config file.
+// Precedence is: command line flag, REGIOND_* environment variable, config file, flag default.
+func ApplyConfig(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Name == "config" || !viper.IsSet(f.Name) {
+			return
+		}
+		if e := f.Value.Set(configString(viper.Get(f.Name))); e != nil {
+			err = fmt.Errorf("config %s: %v", f.Name, e)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	Pools, RegionConfigs, ResolverConfigs, RouteConfigs, AccessConfigs, MaintenanceConfigs = nil, nil, nil, nil, nil, nil
+	Headers = HeadersConfig{}
+	if err := viper.UnmarshalKey("pools", &Pools); err != nil {
+		return fmt.Errorf("config pools: %v", err)
+	}
+	if err := viper.UnmarshalKey("regions", &RegionConfigs); err != nil {
+		return fmt.Errorf("config regions: %v", err)
+	}
+	if err := viper.UnmarshalKey("resolvers", &ResolverConfigs); err != nil {
+		return fmt.Errorf("config resolvers: %v", err)
+	}
+	if err := viper.UnmarshalKey("routes", &RouteConfigs); err != nil {
+		return fmt.Errorf("config routes: %v", err)
+	}
+	if err := viper.UnmarshalKey("access", &AccessConfigs); err != nil {
+		return fmt.Errorf("config access: %v", err)
+	}
+	if err := viper.UnmarshalKey("maintenance", &MaintenanceConfigs); err != nil {
+		return fmt.Errorf("config maintenance: %v", err)
+	}
+	if err := viper.UnmarshalKey("headers", &Headers); err != nil {
+		return fmt.Errorf("config headers: %v", err)
+	}
+	return nil
+}
+
+// Converts config value to flag value string, lists are joined by comma
+func configString(v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	case []string:
+		return strings.Join(v, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// Exit codes of config commands
+const (
+	exitConfigInvalid  = 1
+	exitConfigLoad     = 2
+	exitResolverFailed = 3
+)
+
+var (
+	strictConfig   bool
+	checkResolvers bool
+	configCmd      = &cobra.Command{
+		Use:   "config",
+		Short: "Check and print configuration",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if err := ApplyConfig(cmd.Flags()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(exitConfigLoad)
+			}
+		},
+	}
+	configValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Validate configuration the same way proxy loads it",
+		Long: `Validate configuration the same way proxy loads it.
+Exit codes: 0 - valid, 1 - invalid, 2 - config can't be loaded, 3 - resolver is not reachable.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			warnings, err := ValidateConfig(strictConfig)
+			for _, w := range warnings {
+				fmt.Fprintln(os.Stderr, "Warning:", w)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(exitConfigInvalid)
+			}
+			if checkResolvers {
+				if err := pingOracle(); err != nil {
+					fmt.Fprintln(os.Stderr, "Error: Oracle:", err)
+					os.Exit(exitResolverFailed)
+				}
+			}
+			fmt.Println("Config is valid")
+		},
+	}
+	configPrintCmd = &cobra.Command{
+		Use:   "print",
+		Short: "Print effective configuration in YAML with secrets redacted",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := PrintConfig(os.Stdout, cmd.Flags()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(exitConfigLoad)
+			}
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configPrintCmd)
+	addProxyFlags(configCmd.PersistentFlags())
+	configValidateCmd.Flags().BoolVar(&strictConfig, "strict", false, "Treat warnings as errors")
+	configValidateCmd.Flags().BoolVar(&checkResolvers, "check-resolvers", false, "Check that Oracle database is reachable")
+}
+
+// ValidateConfig checks pools, regions, resolvers, upstreams, limits, trusted proxies and TLS settings.
+// Overlapping CIDRs of different regions are reported as warnings, or as error in strict mode.
+func ValidateConfig(strict bool) ([]string, error) {
+	if err := ValidateRouting(); err != nil {
+		return nil, err
+	}
+	if _, err := ParseNetworks(TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted proxies: %v", err)
+	}
+	if TLSCert != "" || TLSCertDir != "" {
+		store, err := NewCertStore(TLSCert, TLSKey, TLSCertDir)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := NewTLSConfig(store, TLSClientCA, TLSClientAuth); err != nil {
+			return nil, err
+		}
+	}
+
+	warnings, err := overlappingCIDRs()
+	if err == nil && strict && len(warnings) > 0 {
+		err = fmt.Errorf("%d warnings in strict mode", len(warnings))
+	}
+	return warnings, err
+}
+
+// Reports networks of different regions which overlap. The same network mapped to different regions is an error.
+func overlappingCIDRs() ([]string, error) {
+	type entry struct {
+		net    *net.IPNet
+		region string
+	}
+	var entries []entry
+	mappings := append([]string{}, RegionCIDRs...)
+	for _, c := range RegionConfigs {
+		for _, cidr := range c.CIDRs {
+			mappings = append(mappings, cidr+"="+strconv.Itoa(c.ID))
+		}
+	}
+	for _, m := range mappings {
+		kv := strings.SplitN(m, "=", 2)
+		nets, err := ParseNetworks(kv[:1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{net: nets[0], region: kv[len(kv)-1]})
+	}
+
+	var warnings []string
+	for i, a := range entries {
+		for _, b := range entries[i+1:] {
+			if a.region == b.region || !(a.net.Contains(b.net.IP) || b.net.Contains(a.net.IP)) {
+				continue
+			}
+			if a.net.String() == b.net.String() {
+				return warnings, fmt.Errorf("%s is mapped to regions %s and %s", a.net, a.region, b.region)
+			}
+			warnings = append(warnings, fmt.Sprintf("%s (region %s) overlaps %s (region %s), the most specific one wins", a.net, a.region, b.net, b.region))
+		}
+	}
+	return warnings, nil
+}
+
+// Checks that Oracle database is reachable if Oracle resolver is used
+func pingOracle() error {
+	used := len(ResolverConfigs) == 0
+	for _, c := range ResolverConfigs {
+		used = used || c.Type == "oracle"
+	}
+	if !used {
+		return nil
+	}
+	ora, err := sql.Open("oci8", OraConnStr)
+	if err != nil {
+		return err
+	}
+	defer ora.Close()
+	return ora.Ping()
+}
+
+// PrintConfig writes effective configuration in YAML with secrets redacted
+func PrintConfig(w io.Writer, flags *pflag.FlagSet) error {
+	m := make(map[string]interface{})
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" || f.Name == "help" {
+			return
+		}
+		m[f.Name] = redact(f.Name, flagValue(f))
+	})
+
+	pools := make(map[string]PoolConfig)
+	for name, p := range Pools {
+		var upstreams []string
+		for _, u := range p.Upstreams {
+			upstreams = append(upstreams, redact("upstreams", u).(string))
+		}
+		p.Upstreams = upstreams
+		pools[name] = p
+	}
+	m["pools"] = pools
+	m["regions"] = RegionConfigs
+	m["resolvers"] = ResolverConfigs
+	m["routes"] = RouteConfigs
+	m["access"] = AccessConfigs
+	m["maintenance"] = MaintenanceConfigs
+	m["headers"] = Headers
+
+	out, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// Returns typed flag value
+func flagValue(f *pflag.Flag) interface{} {
+	s := f.Value.String()
+	switch f.Value.Type() {
+	case "stringSlice":
+		s = strings.Trim(s, "[]")
+		if s == "" {
+			return []string{}
+		}
+		items, err := csv.NewReader(strings.NewReader(s)).Read()
+		if err != nil {
+			return s
+		}
+		return items
+	case "int", "int64":
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return v
+		}
+	case "bool":
+		if v, err := strconv.ParseBool(s); err == nil {
+			return v
+		}
+	}
+	return s
+}
+
+// Hides passwords in Oracle connection string, upstream and registry URLs, and secret keys
+func redact(name string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case []string:
+		var items []interface{}
+		for _, item := range v {
+			items = append(items, redact(name, item))
+		}
+		return items
+	case string:
+		switch name {
+		case "oracle":
+			// user/pass@host/sid
+			if i, j := strings.Index(v, "/"), strings.LastIndex(v, "@"); i >= 0 && j > i {
+				return v[:i+1] + "xxxxx" + v[j:]
+			}
+		case "upstreams", "consul-addr", "etcd-addr":
+			if u, err := url.Parse(v); err == nil && u.User != nil {
+				return u.Redacted()
+			}
+		case "override-key", "affinity-keys", "jwt-keys":
+			if v != "" {
+				return "xxxxx"
+			}
+		}
+	}
+	return v
+}
@@ -0,0 +1,400 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delay before retrying failed request to service registry
+const discoveryRetryDelay = 5 * time.Second
+
+// Maximum time blocking query to Consul waits for changes
+const consulWait = 5 * time.Minute
+
+var (
+	// ConsulAddr is Consul HTTP API address
+	ConsulAddr string
+	// EtcdAddr is etcd v3 HTTP API (gRPC gateway) address
+	EtcdAddr string
+)
+
+// NewConsulPool creates pool which targets are healthy instances of Consul service watched by blocking queries.
+// Upstream is in form of '[scheme://]service[/base][?tag=name&option=value]', its scheme, base path and options
+// are applied to every instance. Instances are selected by tag if it is specified and weighted by their passing weight.
+func NewConsulPool(name string, upstream string) (*Pool, error) {
+	template, opts, err := ParseUpstream(upstream, UpstreamTransport)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %v", name, err)
+	}
+	tr, err := NewTransport(opts)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: upstream %s: %v", name, upstream, err)
+	}
+	q := template.Query()
+	w := &consulWatcher{
+		addr:     strings.TrimSuffix(ConsulAddr, "/"),
+		service:  template.Hostname(),
+		tag:      q.Get("tag"),
+		template: template,
+	}
+	q.Del("tag")
+	template.RawQuery = q.Encode()
+
+	pool := newDiscoveredPool(name, tr)
+	watchRegistry(pool, "Consul service "+w.service, w.fetch)
+	return pool, nil
+}
+
+// NewEtcdPool creates pool which targets are values of etcd keys with prefix. Every value is an upstream
+// in form of 'host:port' or 'scheme://host:port/base?option=value'. Keys are watched for changes.
+func NewEtcdPool(name string, prefix string) (*Pool, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("pool %s: etcd key prefix is empty", name)
+	}
+	transports := &dynamicTransports{}
+	w := &etcdWatcher{
+		addr:       strings.TrimSuffix(EtcdAddr, "/"),
+		prefix:     prefix,
+		defaults:   UpstreamTransport,
+		transports: transports,
+		cache:      make(map[string]http.RoundTripper),
+	}
+	pool := newDiscoveredPool(name, transports)
+	watchRegistry(pool, "etcd prefix "+prefix, w.fetch)
+	return pool, nil
+}
+
+// Creates empty pool which targets are updated in background
+func newDiscoveredPool(name string, tr http.RoundTripper) *Pool {
+	return &Pool{
+		Name:      name,
+		Transport: tr,
+		weights:   []int{},
+		stop:      make(chan struct{}),
+	}
+}
+
+// Fetches upstreams from registry, blocks until they are changed if registry supports it
+type fetchFunc func(ctx context.Context) ([]*url.URL, []int, error)
+
+// Updates pool targets by fetching them from registry until pool is closed.
+// The first fetch is done synchronously so pool is ready to use if registry is available.
+func watchRegistry(pool *Pool, source string, fetch fetchFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var current string
+	update := func(ctx context.Context) error {
+		targets, weights, err := fetch(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Pool %s: %s is not fetched: %v\n", pool.Name, source, err)
+			}
+			return err
+		}
+		var members []string
+		for i, t := range targets {
+			members = append(members, t.Host+"/"+strconv.Itoa(weights[i]))
+		}
+		if s := strings.Join(members, ","); s != current {
+			current = s
+			pool.SetTargets(targets, weights)
+			log.Printf("Pool %s: %s is resolved to [%s]\n", pool.Name, source, current)
+		}
+		return nil
+	}
+
+	first, cancelFirst := context.WithTimeout(ctx, discoveryRetryDelay)
+	update(first)
+	cancelFirst()
+
+	go func() {
+		<-pool.stop
+		cancel()
+	}()
+	go func() {
+		for ctx.Err() == nil {
+			if err := update(ctx); err != nil {
+				select {
+				case <-ctx.Done():
+				case <-time.After(discoveryRetryDelay):
+				}
+			}
+		}
+	}()
+}
+
+type consulWatcher struct {
+	// Address is copied on creation, so watcher is not affected by reload
+	addr     string
+	service  string
+	tag      string
+	template *url.URL
+	index    uint64
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// Fetches healthy service instances, the first call returns immediately,
+// next ones are blocking queries which return when instances are changed.
+func (w *consulWatcher) fetch(ctx context.Context) ([]*url.URL, []int, error) {
+	q := url.Values{}
+	q.Set("passing", "1")
+	if w.tag != "" {
+		q.Set("tag", w.tag)
+	}
+	if w.index > 0 {
+		q.Set("index", strconv.FormatUint(w.index, 10))
+		q.Set("wait", consulWait.String())
+	}
+	req, err := http.NewRequest("GET", w.addr+"/v1/health/service/"+url.PathEscape(w.service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, nil, err
+	}
+
+	// Index going backwards means that Consul state is reset, so watch is restarted
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if index < w.index {
+		index = 0
+	}
+	w.index = index
+
+	targets := []*url.URL{}
+	weights := []int{}
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		t := *w.template
+		t.Host = net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+		weight := e.Service.Weights.Passing
+		if weight <= 0 {
+			weight = 1
+		}
+		targets = append(targets, &t)
+		weights = append(weights, weight)
+	}
+	return targets, weights, nil
+}
+
+type etcdWatcher struct {
+	// Address and default transport options are copied on creation, so watcher is not affected by reload
+	addr       string
+	prefix     string
+	defaults   TransportOptions
+	transports *dynamicTransports
+	cache      map[string]http.RoundTripper
+	revision   int64
+}
+
+type etcdKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type etcdRangeResponse struct {
+	Header struct {
+		Revision int64 `json:"revision,string"`
+	} `json:"header"`
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Events []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Fetches keys with prefix, the first call returns immediately,
+// next ones watch keys and return when any of them is changed.
+func (w *etcdWatcher) fetch(ctx context.Context) ([]*url.URL, []int, error) {
+	if w.revision > 0 {
+		if err := w.wait(ctx); err != nil {
+			// Keys are fetched again in case revision is compacted
+			w.revision = 0
+			return nil, nil, err
+		}
+	}
+
+	var resp etcdRangeResponse
+	if err := w.call(ctx, "/v3/kv/range", w.request(nil), &resp); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return resp.Kvs[i].Key < resp.Kvs[j].Key })
+
+	targets := []*url.URL{}
+	weights := []int{}
+	transports := make(UpstreamTransports)
+	options := make(map[string]TransportOptions)
+	cache := make(map[string]http.RoundTripper)
+	for _, kv := range resp.Kvs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		upstream := strings.TrimSpace(string(value))
+		u, opts, err := ParseUpstream(upstream, w.defaults)
+		if err != nil {
+			log.Printf("Etcd prefix %s: %v\n", w.prefix, err)
+			continue
+		}
+		if err := checkTransport(options, transportKey(u), opts); err != nil {
+			log.Printf("Etcd prefix %s: upstream %s: %v\n", w.prefix, upstream, err)
+			continue
+		}
+		// Transports are reused while upstream is not changed to keep its connections
+		tr, ok := w.cache[upstream]
+		if !ok {
+			if tr, err = NewTransport(opts); err != nil {
+				log.Printf("Etcd prefix %s: upstream %s: %v\n", w.prefix, upstream, err)
+				continue
+			}
+		}
+		cache[upstream] = tr
+		transports[transportKey(u)] = tr
+		targets = append(targets, u)
+		weights = append(weights, 1)
+	}
+	w.cache = cache
+	w.transports.set(transports)
+	w.revision = resp.Header.Revision
+	return targets, weights, nil
+}
+
+// Waits for any change of keys after the last fetched revision
+func (w *etcdWatcher) wait(ctx context.Context) error {
+	create := w.request(map[string]interface{}{"start_revision": strconv.FormatInt(w.revision+1, 10)})
+	body, err := json.Marshal(map[string]interface{}{"create_request": create})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.addr+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// Watch response is a stream of JSON objects, the first one confirms watch creation
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg etcdWatchResponse
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("watch: %s", msg.Error.Message)
+		}
+		if len(msg.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+// Creates range request for all keys with prefix
+func (w *etcdWatcher) request(fields map[string]interface{}) map[string]interface{} {
+	end := []byte(w.prefix)
+	end[len(end)-1]++
+	req := map[string]interface{}{
+		"key":       base64.StdEncoding.EncodeToString([]byte(w.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	}
+	for k, v := range fields {
+		req[k] = v
+	}
+	return req
+}
+
+func (w *etcdWatcher) call(ctx context.Context, path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// Transports of discovered upstreams which are replaced in background
+type dynamicTransports struct {
+	mu         sync.RWMutex
+	transports UpstreamTransports
+}
+
+func (t *dynamicTransports) set(transports UpstreamTransports) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.transports = transports
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *dynamicTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	transports := t.transports
+	t.mu.RUnlock()
+	return transports.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections of all transports
+func (t *dynamicTransports) CloseIdleConnections() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	t.transports.CloseIdleConnections()
+}
@@ -0,0 +1,611 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// DNS record types and classes answered by GeoDNS
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypeAAAA  = 28
+	dnsTypeOPT   = 41
+	dnsTypeANY   = 255
+	dnsClassIN   = 1
+	// EDNS Client Subnet option code
+	dnsOptionECS = 8
+)
+
+// DNS response codes
+const (
+	dnsSuccess  = 0
+	dnsFormErr  = 1
+	dnsServFail = 2
+	dnsNXDomain = 3
+	dnsNotImp   = 4
+	dnsRefused  = 5
+)
+
+// Idle timeout of DNS over TCP connection
+const dnsTCPTimeout = 10 * time.Second
+
+var (
+	// DNSZone is zone GeoDNS server is authoritative for, e.g. example.com
+	DNSZone string
+	// DNSTTL is time-to-live of answered records in seconds
+	DNSTTL int
+	// DNSClientSubnet enables resolution of region by EDNS Client Subnet instead of resolver address
+	DNSClientSubnet bool
+	dnsStats        = expvar.NewMap("dns")
+	dnsCmd          = &cobra.Command{
+		Use:   "dns",
+		Short: "Run GeoDNS server",
+		Run: func(cmd *cobra.Command, args []string) {
+			if metricsPort > 0 {
+				go http.ListenAndServe(":"+strconv.Itoa(metricsPort), nil)
+				log.Printf("Metrics HTTP server is listening on port %d\n", metricsPort)
+			}
+			env := openEnv()
+			defer env.Close()
+			d := NewGeoDNS(env)
+			if err := d.WatchReload(cmd.Flags()); err != nil {
+				log.Fatal(err)
+			}
+			conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+			if err != nil {
+				log.Fatal(err)
+			}
+			ln, err := newListener(port)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go func() {
+				if err := d.ServeUDP(conn); err != nil {
+					log.Fatal(err)
+				}
+			}()
+			go func() {
+				if err := d.ServeTCP(ln); err != nil {
+					log.Fatal(err)
+				}
+			}()
+
+			_, cancel := waitShutdown()
+			defer cancel()
+			d.Shutdown()
+			d.Close()
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(dnsCmd)
+	addProxyFlags(dnsCmd.PersistentFlags())
+	addDNSFlags(dnsCmd.PersistentFlags())
+}
+
+// Adds GeoDNS flags, they are not reloadable since zone is fixed for server lifetime
+func addDNSFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&DNSZone, "dns-zone", "", "Zone GeoDNS server is authoritative for, e.g. example.com")
+	fs.IntVar(&DNSTTL, "dns-ttl", 60, "Time-to-live of answered records in seconds")
+	fs.BoolVar(&DNSClientSubnet, "dns-client-subnet", true, "Resolve region by EDNS Client Subnet of query if it is present instead of resolver address")
+}
+
+// Record of region answered by GeoDNS
+type dnsRecord struct {
+	Type uint16
+	// Data is address of A and AAAA records and name of CNAME record
+	Data []byte
+}
+
+// Records of region by name relative to zone, '@' is zone apex
+type dnsRecords map[string][]dnsRecord
+
+// Parses records in form of 'name type value', e.g. 'www A 192.0.2.1' or 'api CNAME api-east.example.net.'.
+// Names are relative to zone, CNAME targets without trailing dot are relative to zone too.
+func parseRecords(records []string) (dnsRecords, error) {
+	parsed := make(dnsRecords)
+	for _, s := range records {
+		fields := strings.Fields(s)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("record '%s' must be in form of 'name type value'", s)
+		}
+		name := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		var r dnsRecord
+		switch strings.ToUpper(fields[1]) {
+		case "A":
+			ip := net.ParseIP(fields[2]).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("record '%s': invalid IPv4 address", s)
+			}
+			r = dnsRecord{Type: dnsTypeA, Data: ip}
+		case "AAAA":
+			ip := net.ParseIP(fields[2])
+			if ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("record '%s': invalid IPv6 address", s)
+			}
+			r = dnsRecord{Type: dnsTypeAAAA, Data: ip}
+		case "CNAME":
+			r = dnsRecord{Type: dnsTypeCNAME, Data: []byte(strings.ToLower(fields[2]))}
+		default:
+			return nil, fmt.Errorf("record '%s': unsupported type, A, AAAA or CNAME is expected", s)
+		}
+		parsed[name] = append(parsed[name], r)
+	}
+	for name, rs := range parsed {
+		for _, r := range rs {
+			if r.Type == dnsTypeCNAME && len(rs) > 1 {
+				return nil, fmt.Errorf("record %s: CNAME can't coexist with other records", name)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// GeoDNS is authoritative DNS server for zone which answers queries with records of region resolved from
+// resolver address or EDNS Client Subnet. Region resolution, caching, failover and maintenance are shared
+// with HTTP proxy, so clients get records of region they are proxied to.
+type GeoDNS struct {
+	*Proxy
+	Zone   string
+	mu     sync.Mutex
+	conn   net.PacketConn
+	ln     net.Listener
+	closed bool
+}
+
+// NewGeoDNS creates GeoDNS server for zone from --dns-zone flag
+func NewGeoDNS(env *Env) *GeoDNS {
+	zone := strings.ToLower(strings.TrimSuffix(DNSZone, "."))
+	if zone == "" {
+		log.Fatal("DNS zone is not specified")
+	}
+	d := &GeoDNS{Proxy: newProxy(env), Zone: zone}
+	routing := d.routing.Load()
+	log.Printf("GeoDNS server for zone %s is listening on port %d for %d regions with TTL %d seconds", zone, port, len(routing.records), routing.TTL)
+	return d
+}
+
+// ServeUDP answers queries received on conn until it is closed by Shutdown
+func (d *GeoDNS) ServeUDP(conn net.PacketConn) error {
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if d.isClosed() {
+				return nil
+			}
+			return err
+		}
+		var ip net.IP
+		if a, ok := addr.(*net.UDPAddr); ok {
+			ip = a.IP
+		}
+		if resp := d.answer(buf[:n], ip, false); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// ServeTCP answers queries of connections accepted on listener until it is closed by Shutdown
+func (d *GeoDNS) ServeTCP(ln net.Listener) error {
+	d.mu.Lock()
+	d.ln = ln
+	d.mu.Unlock()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			if d.isClosed() {
+				return nil
+			}
+			return err
+		}
+		go d.handleTCP(c)
+	}
+}
+
+// Shutdown stops answering queries
+func (d *GeoDNS) Shutdown() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.conn != nil {
+		d.conn.Close()
+	}
+	if d.ln != nil {
+		d.ln.Close()
+	}
+}
+
+func (d *GeoDNS) isClosed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+// Answers queries of TCP connection, every message is prefixed with its length
+func (d *GeoDNS) handleTCP(c net.Conn) {
+	defer c.Close()
+	ip := net.ParseIP(hostOnly(c.RemoteAddr().String()))
+	for {
+		c.SetDeadline(time.Now().Add(dnsTCPTimeout))
+		var size [2]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(c, query); err != nil {
+			return
+		}
+		resp := d.answer(query, ip, true)
+		if resp == nil {
+			return
+		}
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// Query parsed from DNS message
+type dnsQuery struct {
+	ID       uint16
+	Flags    uint16
+	Name     string
+	Type     uint16
+	Class    uint16
+	Question []byte
+	// EDNS is set if query has OPT record, UDPSize is payload size it advertises
+	EDNS    bool
+	UDPSize int
+	// Subnet is EDNS Client Subnet option if query has one
+	Subnet       *net.IPNet
+	SubnetFamily uint16
+	SubnetBits   int
+}
+
+// Returns response to query from client with ip, nil if query is not worth answering
+func (d *GeoDNS) answer(msg []byte, ip net.IP, tcp bool) []byte {
+	dnsStats.Add("queries", 1)
+	q, rcode := parseQuery(msg)
+	if q == nil {
+		dnsStats.Add("errors", 1)
+		return nil
+	}
+	if rcode != dnsSuccess {
+		dnsStats.Add("errors", 1)
+		return d.response(q, rcode, nil, false, tcp)
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if q.Class != dnsClassIN || (name != d.Zone && !strings.HasSuffix(name, "."+d.Zone)) {
+		dnsStats.Add("refused", 1)
+		return d.response(q, dnsRefused, nil, false, tcp)
+	}
+	relative := "@"
+	if name != d.Zone {
+		relative = strings.TrimSuffix(name, "."+d.Zone)
+	}
+
+	// Client subnet with zero source prefix means that client opts out of sending its subnet
+	if DNSClientSubnet && q.Subnet != nil && q.SubnetBits > 0 {
+		dnsStats.Add("client-subnet", 1)
+		ip = q.Subnet.IP
+	}
+	routing := d.routing.Load().unmatched
+	if routing == nil || ip == nil {
+		return d.response(q, dnsRefused, nil, false, tcp)
+	}
+	region := d.region(routing, CanonicalIP(ip.String()))
+	if region == 0 {
+		dnsStats.Add("errors", 1)
+		return d.response(q, dnsServFail, nil, false, tcp)
+	}
+	dnsStats.Add("region."+strconv.Itoa(region)+".queries", 1)
+
+	records, ok := routing.records[region][relative]
+	if !ok {
+		records, ok = routing.records[routing.fallback][relative]
+	}
+	if !ok && relative != "@" {
+		dnsStats.Add("nxdomain", 1)
+		return d.response(q, dnsNXDomain, nil, true, tcp)
+	}
+	var answers []dnsRecord
+	for _, r := range records {
+		if r.Type == q.Type || r.Type == dnsTypeCNAME || q.Type == dnsTypeANY {
+			answers = append(answers, r)
+		}
+	}
+	if relative == "@" && (q.Type == dnsTypeSOA || q.Type == dnsTypeANY) {
+		answers = append(answers, dnsRecord{Type: dnsTypeSOA})
+	}
+	return d.response(q, dnsSuccess, answers, len(answers) == 0, tcp)
+}
+
+// Resolves region of client. Region with pool is resolved with cache, failover and maintenance of proxy,
+// so client gets records of region it would be proxied to. Region without pool is resolved by resolvers
+// only, as it has no upstreams. Returns zero if region is not resolved.
+func (d *GeoDNS) region(routing *Routing, client string) int {
+	if routing.dnsOnly {
+		if region, err := routing.Resolver.Resolve(client); err == nil {
+			if _, ok := routing.Regions[region]; !ok {
+				if _, ok := routing.records[region]; ok {
+					return region
+				}
+			}
+		}
+	}
+	if len(routing.Regions) == 0 {
+		return routing.fallback
+	}
+	key := routing.cacheKey(ClientKey(client, routing.IPv6Prefix))
+	u := d.upstream(routing, "", client, key)
+	if u == nil {
+		return 0
+	}
+	if f := routing.failover(u, key); f != nil {
+		u = f
+	}
+	if m := routing.underMaintenance(u); m != nil {
+		if fallback := m.fallback(routing, key); fallback != nil {
+			u = fallback
+		}
+	}
+	return u.Region
+}
+
+// Parses the only question and EDNS options of query. Returns nil if message is not a query at all.
+func parseQuery(msg []byte) (*dnsQuery, int) {
+	if len(msg) < 12 {
+		return nil, 0
+	}
+	q := &dnsQuery{ID: binary.BigEndian.Uint16(msg), Flags: binary.BigEndian.Uint16(msg[2:])}
+	if q.Flags&0x8000 != 0 {
+		return nil, 0
+	}
+	if opcode := q.Flags >> 11 & 0xf; opcode != 0 {
+		return q, dnsNotImp
+	}
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return q, dnsFormErr
+	}
+	name, off, err := readName(msg, 12)
+	if err != nil || off+4 > len(msg) {
+		return q, dnsFormErr
+	}
+	q.Name = name
+	q.Type = binary.BigEndian.Uint16(msg[off:])
+	q.Class = binary.BigEndian.Uint16(msg[off+2:])
+	off += 4
+	q.Question = msg[12:off]
+
+	// OPT record is looked for in all sections after question
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < count; i++ {
+		if _, off, err = readName(msg, off); err != nil || off+10 > len(msg) {
+			return q, dnsFormErr
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		size := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+size > len(msg) {
+			return q, dnsFormErr
+		}
+		if typ == dnsTypeOPT {
+			q.EDNS, q.UDPSize = true, int(class)
+			if err := q.parseOptions(msg[off : off+size]); err != nil {
+				return q, dnsFormErr
+			}
+		}
+		off += size
+	}
+	return q, dnsSuccess
+}
+
+// Parses EDNS Client Subnet option from OPT record data
+func (q *dnsQuery) parseOptions(data []byte) error {
+	for len(data) >= 4 {
+		code := binary.BigEndian.Uint16(data)
+		size := int(binary.BigEndian.Uint16(data[2:]))
+		if 4+size > len(data) {
+			return errors.New("truncated EDNS option")
+		}
+		option := data[4 : 4+size]
+		data = data[4+size:]
+		if code != dnsOptionECS {
+			continue
+		}
+		if len(option) < 4 {
+			return errors.New("short client subnet option")
+		}
+		family, bits := binary.BigEndian.Uint16(option), int(option[2])
+		var ip net.IP
+		switch family {
+		case 1:
+			ip = make(net.IP, net.IPv4len)
+		case 2:
+			ip = make(net.IP, net.IPv6len)
+		default:
+			return fmt.Errorf("unknown client subnet family %d", family)
+		}
+		if bits > len(ip)*8 || len(option)-4 > len(ip) {
+			return errors.New("invalid client subnet prefix")
+		}
+		copy(ip, option[4:])
+		q.Subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, len(ip)*8)}
+		q.SubnetFamily, q.SubnetBits = family, bits
+	}
+	return nil
+}
+
+// Builds authoritative response to query. SOA record of zone is added to authority section of negative
+// responses. Response which doesn't fit UDP payload size is truncated, so client retries by TCP.
+func (d *GeoDNS) response(q *dnsQuery, rcode int, answers []dnsRecord, negative bool, tcp bool) []byte {
+	var records [][]byte
+	for _, r := range answers {
+		// Answers are named by question which is at offset 12
+		records = append(records, d.record([]byte{0xc0, 12}, r))
+	}
+	var authority [][]byte
+	if negative {
+		authority = append(authority, d.record(encodeName(d.Zone), dnsRecord{Type: dnsTypeSOA}))
+	}
+
+	limit := 65535
+	if !tcp {
+		limit = 512
+		if q.EDNS && q.UDPSize > limit {
+			limit = q.UDPSize
+		}
+	}
+	flags := 0x8000 | q.Flags&0x7900 | 0x0400 | uint16(rcode)
+	build := func(records, authority [][]byte) []byte {
+		msg := binary.BigEndian.AppendUint16(nil, q.ID)
+		msg = binary.BigEndian.AppendUint16(msg, flags)
+		var questions uint16
+		if q.Question != nil {
+			questions = 1
+		}
+		msg = binary.BigEndian.AppendUint16(msg, questions)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(records)))
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(authority)))
+		var additional uint16
+		if q.EDNS {
+			additional = 1
+		}
+		msg = binary.BigEndian.AppendUint16(msg, additional)
+		msg = append(msg, q.Question...)
+		for _, r := range append(records, authority...) {
+			msg = append(msg, r...)
+		}
+		if q.EDNS {
+			msg = append(msg, q.opt()...)
+		}
+		return msg
+	}
+	msg := build(records, authority)
+	if len(msg) > limit {
+		dnsStats.Add("truncated", 1)
+		flags |= 0x0200
+		msg = build(nil, nil)
+	}
+	return msg
+}
+
+// Encodes resource record of zone with owner name
+func (d *GeoDNS) record(owner []byte, r dnsRecord) []byte {
+	var data []byte
+	switch r.Type {
+	case dnsTypeCNAME:
+		target := string(r.Data)
+		if !strings.HasSuffix(target, ".") {
+			target += "." + d.Zone
+		}
+		data = encodeName(target)
+	case dnsTypeSOA:
+		data = append(encodeName("ns."+d.Zone), encodeName("hostmaster."+d.Zone)...)
+		// Serial, refresh, retry, expire and negative caching TTL
+		for _, v := range []uint32{1, 3600, 600, 86400, uint32(DNSTTL)} {
+			data = binary.BigEndian.AppendUint32(data, v)
+		}
+	default:
+		data = r.Data
+	}
+	msg := append([]byte{}, owner...)
+	msg = binary.BigEndian.AppendUint16(msg, r.Type)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(DNSTTL))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+// Returns OPT record of response, client subnet is echoed with scope equal to its source prefix
+func (q *dnsQuery) opt() []byte {
+	msg := []byte{0}
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, 1232)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	if q.Subnet == nil {
+		return binary.BigEndian.AppendUint16(msg, 0)
+	}
+	address := q.Subnet.IP
+	if q.SubnetFamily == 1 {
+		address = address.To4()
+	}
+	address = address[:(q.SubnetBits+7)/8]
+	msg = binary.BigEndian.AppendUint16(msg, uint16(8+len(address)))
+	msg = binary.BigEndian.AppendUint16(msg, dnsOptionECS)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(4+len(address)))
+	msg = binary.BigEndian.AppendUint16(msg, q.SubnetFamily)
+	msg = append(msg, byte(q.SubnetBits), byte(q.SubnetBits))
+	return append(msg, address...)
+}
+
+// Reads possibly compressed name at offset of message, returns name and offset after it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("truncated name")
+		}
+		size := int(msg[off])
+		switch {
+		case size == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case size&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+size > len(msg) {
+				return "", 0, errors.New("truncated label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+size]))
+			off += 1 + size
+		}
+	}
+}
+
+// Encodes name as sequence of labels
+func encodeName(name string) []byte {
+	var msg []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
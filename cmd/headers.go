@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Headers holds global header rewriting rules from config file
+var Headers HeadersConfig
+
+// Placeholders of header values, they are replaced with routing context of request
+var headerPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+var headerVars = map[string]bool{
+	"{client-ip}": true,
+	"{region}":    true,
+	"{upstream}":  true,
+	"{pool}":      true,
+	"{route}":     true,
+}
+
+// Checks header names and placeholders of rules
+func (c HeadersConfig) validate() error {
+	for _, rules := range []HeaderRules{c.Request, c.Response} {
+		for _, values := range []map[string]string{rules.Set, rules.Add} {
+			for name, value := range values {
+				if !validHeaderName(name) {
+					return fmt.Errorf("headers: invalid header name '%s'", name)
+				}
+				for _, p := range headerPlaceholder.FindAllString(value, -1) {
+					if !headerVars[p] {
+						return fmt.Errorf("headers: %s: unknown placeholder %s", name, p)
+					}
+				}
+			}
+		}
+		for _, name := range rules.Remove {
+			if !validHeaderName(name) {
+				return fmt.Errorf("headers: invalid header name '%s'", name)
+			}
+		}
+	}
+	return nil
+}
+
+func validHeaderName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n:()<>@,;\\\"/[]?={}")
+}
+
+// Applies rules to header, headers are removed first, then set and added. Removed header is kept with nil value,
+// otherwise reverse proxy adds X-Forwarded-For back after rewriting request. Names are canonicalized by header
+// methods, so lower case names of config file are fine.
+func (rules HeaderRules) apply(h http.Header, vars *strings.Replacer) {
+	for _, name := range rules.Remove {
+		h[http.CanonicalHeaderKey(name)] = nil
+	}
+	for name, value := range rules.Set {
+		h.Set(name, vars.Replace(value))
+	}
+	for name, value := range rules.Add {
+		h.Add(name, vars.Replace(value))
+	}
+}
+
+// Returns rules of routing for upstream region from the widest scope to the narrowest one:
+// global, route and region, so narrower scope wins
+func (r *Routing) headerScopes(u *Upstream) []HeadersConfig {
+	scopes := r.headers
+	if c, ok := r.regionHeaders[u.Region]; ok {
+		scopes = append(scopes[:len(scopes):len(scopes)], c)
+	}
+	return scopes
+}
+
+// Returns values of placeholders for request routed to upstream
+func (r *Routing) headerVars(req *http.Request, u *Upstream) *strings.Replacer {
+	return strings.NewReplacer(
+		"{client-ip}", CanonicalIP(ClientIP(req)),
+		"{region}", strconv.Itoa(u.Region),
+		"{upstream}", u.Target.Host,
+		"{pool}", u.Pool,
+		"{route}", r.Name,
+	)
+}
+
+// Rewrites headers of request forwarded to upstream
+func (r *Routing) rewriteRequest(req *http.Request, u *Upstream) {
+	scopes := r.headerScopes(u)
+	if len(scopes) == 0 {
+		return
+	}
+	vars := r.headerVars(req, u)
+	for _, c := range scopes {
+		c.Request.apply(req.Header, vars)
+	}
+}
+
+// Rewrites headers of upstream response
+func (r *Routing) rewriteResponse(resp *http.Response, u *Upstream) {
+	scopes := r.headerScopes(u)
+	if len(scopes) == 0 {
+		return
+	}
+	vars := r.headerVars(resp.Request, u)
+	for _, c := range scopes {
+		c.Response.apply(resp.Header, vars)
+	}
+}
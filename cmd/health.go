@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// HealthPath is path upstreams are checked with, health checks are disabled if empty
+	HealthPath string
+	// HealthTCP enables health checks by TCP connect instead of GET of health path
+	HealthTCP bool
+	// HealthInterval is period upstreams are checked with
+	HealthInterval time.Duration
+	// HealthTimeout is timeout of upstream check
+	HealthTimeout time.Duration
+	// HealthThreshold is number of consecutive checks which change upstream health
+	HealthThreshold int
+	healthStats     = expvar.NewMap("health")
+)
+
+// Healthy checks if upstream of pool passes health checks
+func (p *Pool) Healthy(target *url.URL) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !p.down[target.String()]
+}
+
+// SetHealthy marks upstream of pool as healthy or unhealthy, unhealthy upstreams are picked
+// only if there are no healthy ones
+func (p *Pool) SetHealthy(target *url.URL, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down == nil {
+		p.down = make(map[string]bool)
+	}
+	if healthy {
+		delete(p.down, target.String())
+	} else {
+		p.down[target.String()] = true
+	}
+}
+
+// Checks upstreams of pool every health interval until pool is closed. Upstream is healthy if it
+// responds to GET of health path with 2xx or 3xx status, or accepts TCP connection if TCP checks
+// are enabled. Health is changed by consecutive checks only.
+func (r *Routing) watchHealth(pool *Pool) {
+	if pool.stop == nil {
+		pool.stop = make(chan struct{})
+	}
+	transport := r.poolTransport(pool)
+	path, tcp := HealthPath, HealthTCP
+	interval, timeout, threshold := HealthInterval, HealthTimeout, HealthThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	// Positive streak counts consecutive passed checks, negative one counts failed checks
+	streaks := make(map[string]int)
+	var mu sync.Mutex
+
+	check := func(target *url.URL) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		passed := false
+		var err error
+		if tcp {
+			var c net.Conn
+			if c, err = new(net.Dialer).DialContext(ctx, "tcp", target.Host); err == nil {
+				c.Close()
+				passed = true
+			}
+		} else {
+			u := *target
+			u.Path = singleJoiningSlash(target.Path, path)
+			req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+			var resp *http.Response
+			if resp, err = transport.RoundTrip(req); err == nil {
+				resp.Body.Close()
+				passed = resp.StatusCode < 400
+				if !passed {
+					err = fmt.Errorf("status %d", resp.StatusCode)
+				}
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		key := target.String()
+		streak := streaks[key]
+		if passed != (streak > 0) {
+			streak = 0
+		}
+		if passed {
+			streak++
+		} else {
+			streak--
+		}
+		streaks[key] = streak
+		healthy := pool.Healthy(target)
+		switch {
+		case healthy && streak <= -threshold:
+			pool.SetHealthy(target, false)
+			healthStats.Add("pool."+pool.Name+".down", 1)
+			log.Printf("Pool %s: upstream %s is unhealthy: %v\n", pool.Name, target.Host, err)
+		case !healthy && streak >= threshold:
+			pool.SetHealthy(target, true)
+			healthStats.Add("pool."+pool.Name+".up", 1)
+			log.Printf("Pool %s: upstream %s is healthy again\n", pool.Name, target.Host)
+		}
+	}
+	checkAll := func() {
+		var wg sync.WaitGroup
+		for _, target := range pool.Targets() {
+			wg.Add(1)
+			go func(target *url.URL) {
+				defer wg.Done()
+				check(target)
+			}(target)
+		}
+		wg.Wait()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			checkAll()
+			select {
+			case <-pool.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Returns upstream of the first available region of failover chain for client whose upstream is unhealthy
+// or in maintenance. Another upstream of client pool is tried first, then pools of region failover regions
+// and default region. Client keeps its cached upstream, so it fails back as soon as upstream is available.
+// Returns nil if upstream is available, its region is in maintenance or no region of chain is available.
+func (r *Routing) failover(u *Upstream, key string) *Upstream {
+	pool, ok := r.Pools[u.Pool]
+	if !ok {
+		pool = r.Regions[u.Region]
+	}
+	if pool == nil || r.regionInMaintenance(u.Region) || pool.Healthy(&u.Target) && !r.upstreamInMaintenance(u.Target.String()) {
+		return nil
+	}
+
+	accept := func(t *url.URL) bool { return !r.upstreamInMaintenance(t.String()) }
+	regions := r.failovers[u.Region]
+	if len(regions) > 0 && r.fallback != 0 {
+		regions = append(regions[:len(regions):len(regions)], r.fallback)
+	}
+	if target := pool.PickAvailable(accept); target != nil {
+		return &Upstream{Target: *target, Region: u.Region, Pool: pool.Name, Timestamp: u.Timestamp}
+	}
+	for _, region := range regions {
+		if region == u.Region || r.regionInMaintenance(region) {
+			continue
+		}
+		p := r.Pool(region, key)
+		if p == nil {
+			continue
+		}
+		if target := p.PickAvailable(accept); target != nil {
+			healthStats.Add("region."+strconv.Itoa(u.Region)+".failover", 1)
+			return &Upstream{Target: *target, Region: region, Pool: p.Name, Timestamp: u.Timestamp}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// JWTClaim is claim of verified JWT bearer token clients are routed by instead of IP, e.g. tenant
+	JWTClaim string
+	// JWKSFile is JSON Web Key Set file with keys JWT is verified with
+	JWKSFile string
+	// JWTKeys holds HMAC keys JWT is verified with
+	JWTKeys []string
+	// APIKeyHeader is request header with API key clients are routed by instead of IP
+	APIKeyHeader  string
+	identityStats = expvar.NewMap("identity")
+)
+
+// Identity extracts routing key of client from verified JWT claim or API key header,
+// so clients behind the same NAT may be routed to different regions
+type Identity struct {
+	Claim  string
+	Header string
+	keys   []jwk
+}
+
+// Key of JSON Web Key Set, public key is *rsa.PublicKey, *ecdsa.PublicKey or []byte for HMAC
+type jwk struct {
+	kid string
+	key interface{}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// NewIdentity creates identity from flags. Returns nil if clients are routed by IP only.
+func NewIdentity() (*Identity, error) {
+	if JWTClaim == "" && APIKeyHeader == "" {
+		return nil, nil
+	}
+	id := &Identity{Claim: JWTClaim, Header: APIKeyHeader}
+	if JWTClaim == "" {
+		return id, nil
+	}
+	for _, key := range JWTKeys {
+		if key != "" {
+			id.keys = append(id.keys, jwk{key: []byte(key)})
+		}
+	}
+	if JWKSFile != "" {
+		keys, err := loadJWKS(JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS %s: %v", JWKSFile, err)
+		}
+		id.keys = append(id.keys, keys...)
+	}
+	if len(id.keys) == 0 {
+		return nil, fmt.Errorf("JWT claim requires JWKS file or keys")
+	}
+	return id, nil
+}
+
+// Key returns identity of client the region is resolved by and its cache key. Verified JWT claim
+// is preferred to API key. API key is replaced by its SHA-256 hex digest, so raw keys are neither
+// logged nor cached, and is used only if the digest is one of known identities, since API key is not
+// verified otherwise. Returns empty strings if request has no identity or its identity is rejected.
+func (id *Identity) Key(req *http.Request, ip string, known IdentityTable) (string, string) {
+	if id == nil {
+		return "", ""
+	}
+	if auth := req.Header.Get("Authorization"); id.Claim != "" && len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		value, err := id.claim(auth[7:])
+		if err == nil {
+			identityStats.Add("jwt", 1)
+			return value, "jwt:" + value
+		}
+		identityStats.Add("invalid", 1)
+		log.Printf("[%s] - Error: JWT is rejected: %v\n", ip, err)
+	}
+	if key := req.Header.Get(id.Header); id.Header != "" && key != "" {
+		sum := sha256.Sum256([]byte(key))
+		digest := hex.EncodeToString(sum[:])
+		if _, ok := known[digest]; !ok {
+			identityStats.Add("unknown", 1)
+			return "", ""
+		}
+		identityStats.Add("api-key", 1)
+		return digest, "key:" + digest
+	}
+	return "", ""
+}
+
+// Verifies JWT signature and validity period, then returns value of identity claim
+func (id *Identity) claim(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed signature")
+	}
+	valid := false
+	for _, k := range id.keys {
+		if header.Kid != "" && k.kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if valid = verifyJWT(header.Alg, k.key, parts[0]+"."+parts[1], sig); valid {
+			break
+		}
+	}
+	if !valid {
+		return "", fmt.Errorf("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now > exp {
+		return "", fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return "", fmt.Errorf("token is not valid yet")
+	}
+	switch v := claims[id.Claim].(type) {
+	case string:
+		if v != "" {
+			return v, nil
+		}
+	case float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("claim '%s' is not found", id.Claim)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("malformed token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("malformed token: %v", err)
+	}
+	return nil
+}
+
+// Verifies signature by key of type matching algorithm, so HMAC algorithm is never checked with public key
+func verifyJWT(alg string, key interface{}, signed string, sig []byte) bool {
+	if len(alg) != 5 {
+		return false
+	}
+	var h crypto.Hash
+	var newHash func() hash.Hash
+	switch alg[2:] {
+	case "256":
+		h, newHash = crypto.SHA256, sha256.New
+	case "384":
+		h, newHash = crypto.SHA384, sha512.New384
+	case "512":
+		h, newHash = crypto.SHA512, sha512.New
+	default:
+		return false
+	}
+	digest := newHash()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+
+	switch k := key.(type) {
+	case []byte:
+		if !strings.HasPrefix(alg, "HS") {
+			return false
+		}
+		mac := hmac.New(newHash, k)
+		mac.Write([]byte(signed))
+		return hmac.Equal(sig, mac.Sum(nil))
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			return rsa.VerifyPKCS1v15(k, h, sum, sig) == nil
+		case strings.HasPrefix(alg, "PS"):
+			return rsa.VerifyPSS(k, h, sum, sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, sum, r, s)
+	}
+	return false
+}
+
+// Loads RSA, EC and symmetric keys from JSON Web Key Set file, encryption keys are skipped
+func loadJWKS(filename string) ([]jwk, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	var keys []jwk
+	for i, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decodeInt(k.N)
+			e, err2 := decodeInt(k.E)
+			if err1 != nil || err2 != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("key %d: invalid RSA key", i+1)
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("key %d: unknown curve '%s'", i+1, k.Crv)
+			}
+			x, err1 := decodeInt(k.X)
+			y, err2 := decodeInt(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("key %d: invalid EC key", i+1)
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("key %d: invalid symmetric key", i+1)
+			}
+			key = secret
+		default:
+			return nil, fmt.Errorf("key %d: unknown key type '%s'", i+1, k.Kty)
+		}
+		keys = append(keys, jwk{kid: k.Kid, key: key})
+	}
+	return keys, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// RegionLimits holds per region limits in form of 'region=rate/burst/inflight'
+	RegionLimits []string
+	// ClientLimit holds per client IP limits in form of 'rate/burst/inflight'
+	ClientLimit string
+	limitStats  = expvar.NewMap("limits")
+)
+
+// How often idle client buckets are removed
+const limiterSweepInterval = time.Minute
+
+// LimitOptions holds token bucket rate in requests per second, bucket size
+// and maximum number of in-flight requests. Zero value means no limit.
+type LimitOptions struct {
+	Rate        float64
+	Burst       int
+	MaxInFlight int
+}
+
+// ParseLimit parses limit in form of 'rate/burst/inflight', any part may be empty or omitted
+func ParseLimit(s string) (LimitOptions, error) {
+	var opts LimitOptions
+	var err error
+	parts := strings.Split(s, "/")
+	if len(parts) > 3 {
+		return opts, fmt.Errorf("limit %s: too many parts", s)
+	}
+	if len(parts) > 0 && parts[0] != "" {
+		if opts.Rate, err = strconv.ParseFloat(parts[0], 64); err != nil {
+			return opts, fmt.Errorf("limit %s: rate: %v", s, err)
+		}
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		if opts.Burst, err = strconv.Atoi(parts[1]); err != nil {
+			return opts, fmt.Errorf("limit %s: burst: %v", s, err)
+		}
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		if opts.MaxInFlight, err = strconv.Atoi(parts[2]); err != nil {
+			return opts, fmt.Errorf("limit %s: inflight: %v", s, err)
+		}
+	}
+	if opts.Rate > 0 && opts.Burst <= 0 {
+		opts.Burst = int(math.Max(1, math.Ceil(opts.Rate)))
+	}
+	return opts, nil
+}
+
+// Token bucket with in-flight requests counter
+type bucket struct {
+	opts     LimitOptions
+	tokens   float64
+	last     time.Time
+	inflight int
+}
+
+func newBucket(opts LimitOptions, now time.Time) *bucket {
+	return &bucket{
+		opts:   opts,
+		tokens: float64(opts.Burst),
+		last:   now,
+	}
+}
+
+// Returns token and in-flight slot taken for request which is rejected afterwards
+func (b *bucket) giveBack() {
+	b.inflight--
+	if b.opts.Rate > 0 {
+		b.tokens = math.Min(float64(b.opts.Burst), b.tokens+1)
+	}
+}
+
+// Takes token and in-flight slot. Returns seconds to retry after if limit is exceeded.
+func (b *bucket) take(now time.Time) (bool, int) {
+	if b.opts.MaxInFlight > 0 && b.inflight >= b.opts.MaxInFlight {
+		return false, 1
+	}
+	if b.opts.Rate > 0 {
+		b.tokens = math.Min(float64(b.opts.Burst), b.tokens+now.Sub(b.last).Seconds()*b.opts.Rate)
+		b.last = now
+		if b.tokens < 1 {
+			return false, int(math.Ceil((1 - b.tokens) / b.opts.Rate))
+		}
+		b.tokens--
+	}
+	b.inflight++
+	return true, 0
+}
+
+// Checks if bucket is full and has no in-flight requests
+func (b *bucket) idle(now time.Time) bool {
+	if b.inflight > 0 {
+		return false
+	}
+	return b.opts.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*b.opts.Rate >= float64(b.opts.Burst)
+}
+
+// Limiter limits request rate and in-flight requests per region and per client IP
+type Limiter struct {
+	mu            sync.Mutex
+	regionDefault LimitOptions
+	regionOpts    map[int]LimitOptions
+	regions       map[int]*bucket
+	clients       *clientBuckets
+}
+
+// Client buckets may be shared by limiters of several routes
+type clientBuckets struct {
+	mu        sync.Mutex
+	opts      LimitOptions
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewLimiter creates limiter from region limits in form of 'region=rate/burst/inflight'
+// and client limit in form of 'rate/burst/inflight'. Region '*' sets default limit.
+func NewLimiter(regionLimits []string, clientLimit string) (*Limiter, error) {
+	l := &Limiter{
+		regionOpts: make(map[int]LimitOptions),
+		regions:    make(map[int]*bucket),
+		clients:    &clientBuckets{buckets: make(map[string]*bucket), lastSweep: time.Now()},
+	}
+	for _, s := range regionLimits {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("region limit %s: must be in form of 'region=rate/burst/inflight'", s)
+		}
+		opts, err := ParseLimit(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		if kv[0] == "*" {
+			l.regionDefault = opts
+			continue
+		}
+		region, err := strconv.Atoi(kv[0])
+		if err != nil {
+			return nil, fmt.Errorf("region limit %s: region: %v", s, err)
+		}
+		l.regionOpts[region] = opts
+	}
+	if clientLimit != "" {
+		opts, err := ParseLimit(clientLimit)
+		if err != nil {
+			return nil, err
+		}
+		l.clients.opts = opts
+	}
+	return l, nil
+}
+
+// Makes limiter count clients together with another limiter, so client limit is not multiplied by routes
+func (l *Limiter) shareClients(other *Limiter) {
+	l.clients = other.clients
+}
+
+// Acquire checks limits for request from client IP routed to region.
+// Returns function which must be called when request is finished,
+// or nil and seconds to retry after if any limit is exceeded.
+func (l *Limiter) Acquire(region int, ip string) (func(), int) {
+	now := time.Now()
+	c := l.clients
+	client, retryAfter := c.take(ip, now)
+	if retryAfter > 0 {
+		limitStats.Add("client.rejected", 1)
+		return nil, retryAfter
+	}
+
+	l.mu.Lock()
+	r := l.regions[region]
+	if r == nil {
+		opts, ok := l.regionOpts[region]
+		if !ok {
+			opts = l.regionDefault
+		}
+		r = newBucket(opts, now)
+		l.regions[region] = r
+	}
+	ok, retryAfter := r.take(now)
+	l.mu.Unlock()
+	if !ok {
+		// Client is not charged for request which is not proxied
+		if client != nil {
+			c.mu.Lock()
+			client.giveBack()
+			c.mu.Unlock()
+		}
+		limitStats.Add(fmt.Sprintf("region.%d.rejected", region), 1)
+		return nil, retryAfter
+	}
+	limitStats.Add(fmt.Sprintf("region.%d.inflight", region), 1)
+
+	return func() {
+		l.mu.Lock()
+		r.inflight--
+		l.mu.Unlock()
+		if client != nil {
+			c.mu.Lock()
+			client.inflight--
+			c.mu.Unlock()
+		}
+		limitStats.Add(fmt.Sprintf("region.%d.inflight", region), -1)
+	}, 0
+}
+
+// Takes token of client bucket. Returns nil bucket if client limit is not set,
+// or seconds to retry after if client limit is exceeded.
+func (c *clientBuckets) take(ip string, now time.Time) (*bucket, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+	if c.opts == (LimitOptions{}) {
+		return nil, 0
+	}
+	b := c.buckets[ip]
+	if b == nil {
+		b = newBucket(c.opts, now)
+		c.buckets[ip] = b
+	}
+	if ok, retryAfter := b.take(now); !ok {
+		return nil, retryAfter
+	}
+	return b, 0
+}
+
+// Removes idle client buckets, must be called with mutex held
+func (c *clientBuckets) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < limiterSweepInterval {
+		return
+	}
+	c.lastSweep = now
+	for ip, b := range c.buckets {
+		if b.idle(now) {
+			delete(c.buckets, ip)
+		}
+	}
+	clients := new(expvar.Int)
+	clients.Set(int64(len(c.buckets)))
+	limitStats.Set("clients", clients)
+}
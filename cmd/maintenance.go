@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var maintenanceStats = expvar.NewMap("maintenance")
+
+// Maintenance describes region or single upstream in maintenance
+type Maintenance struct {
+	MaintenanceConfig
+	upstream string
+}
+
+// Creates maintenance from config and checks that its regions exist
+func (r *Routing) newMaintenance(c MaintenanceConfig) (*Maintenance, error) {
+	m := &Maintenance{MaintenanceConfig: c}
+	switch {
+	case c.Region != 0 && c.Upstream != "":
+		return nil, fmt.Errorf("maintenance: either region or upstream must be specified")
+	case c.Region != 0:
+		if _, ok := r.Regions[c.Region]; !ok {
+			return nil, fmt.Errorf("maintenance: region %d is not found", c.Region)
+		}
+	case c.Upstream != "":
+		u, _, err := ParseUpstream(c.Upstream, UpstreamTransport)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance: %v", err)
+		}
+		m.upstream = u.String()
+	default:
+		return nil, fmt.Errorf("maintenance: region or upstream is not specified")
+	}
+	if _, ok := r.Regions[c.FallbackRegion]; c.FallbackRegion != 0 && (!ok || c.FallbackRegion == c.Region) {
+		return nil, fmt.Errorf("maintenance: invalid fallback region %d", c.FallbackRegion)
+	}
+	if m.Response.Status == 0 {
+		m.Response.Status = http.StatusServiceUnavailable
+	}
+	return m, nil
+}
+
+// SetMaintenance puts region or upstream into maintenance, previous maintenance of them is replaced
+func (r *Routing) SetMaintenance(c MaintenanceConfig) error {
+	m, err := r.newMaintenance(c)
+	if err != nil {
+		return err
+	}
+	r.maintenanceMu.Lock()
+	defer r.maintenanceMu.Unlock()
+	r.removeMaintenance(m.Region, m.upstream)
+	r.maintenance = append(r.maintenance, m)
+	return nil
+}
+
+// RemoveMaintenance brings region or upstream back from maintenance
+func (r *Routing) RemoveMaintenance(region int, upstream string) error {
+	if upstream != "" {
+		u, _, err := ParseUpstream(upstream, UpstreamTransport)
+		if err != nil {
+			return err
+		}
+		upstream = u.String()
+	}
+	r.maintenanceMu.Lock()
+	defer r.maintenanceMu.Unlock()
+	if !r.removeMaintenance(region, upstream) {
+		return fmt.Errorf("maintenance is not found")
+	}
+	return nil
+}
+
+// Must be called with maintenance mutex held
+func (r *Routing) removeMaintenance(region int, upstream string) bool {
+	for i, m := range r.maintenance {
+		if m.Region == region && m.upstream == upstream {
+			r.maintenance = append(r.maintenance[:i:i], r.maintenance[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceConfigs returns current maintenance of regions and upstreams
+func (r *Routing) MaintenanceConfigs() []MaintenanceConfig {
+	r.maintenanceMu.RLock()
+	defer r.maintenanceMu.RUnlock()
+	configs := []MaintenanceConfig{}
+	for _, m := range r.maintenance {
+		configs = append(configs, m.MaintenanceConfig)
+	}
+	return configs
+}
+
+// Returns maintenance of upstream or its region, nil if they are not in maintenance
+func (r *Routing) underMaintenance(u *Upstream) *Maintenance {
+	r.maintenanceMu.RLock()
+	defer r.maintenanceMu.RUnlock()
+	target := u.Target.String()
+	for _, m := range r.maintenance {
+		if m.Region == u.Region || m.upstream == target {
+			return m
+		}
+	}
+	return nil
+}
+
+// Checks if region as a whole is in maintenance
+func (r *Routing) regionInMaintenance(region int) bool {
+	r.maintenanceMu.RLock()
+	defer r.maintenanceMu.RUnlock()
+	for _, m := range r.maintenance {
+		if m.Region == region {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if single upstream is in maintenance
+func (r *Routing) upstreamInMaintenance(target string) bool {
+	r.maintenanceMu.RLock()
+	defer r.maintenanceMu.RUnlock()
+	for _, m := range r.maintenance {
+		if m.upstream == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns upstream of fallback region for client of region in maintenance. Sticky cache
+// entry of client is kept, so client returns to its upstream when maintenance is over.
+// Returns nil if there is no fallback region or it has no upstreams.
+func (m *Maintenance) fallback(routing *Routing, key string) *Upstream {
+	if m.FallbackRegion == 0 {
+		return nil
+	}
+	target, pool := routing.Target(m.FallbackRegion, key)
+	if target == nil {
+		return nil
+	}
+	return &Upstream{
+		Target:    *target,
+		Region:    m.FallbackRegion,
+		Pool:      pool,
+		Timestamp: time.Now(),
+	}
+}
+
+func (m *Maintenance) serve(w http.ResponseWriter, req *http.Request) {
+	if m.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+	}
+	m.Response.serve(w, req)
+}
+
+// Serves maintenance of regions and upstreams. GET returns current maintenance, PUT puts region
+// or upstream into maintenance, DELETE with 'region' or 'upstream' query parameter ends it, e.g.
+// curl -X PUT localhost:9091/maintenance -d '{"region": 2, "retry-after": 600, "fallback-region": 1}'.
+// Maintenance of virtual route is managed with 'route' query parameter.
+func (p *Proxy) serveMaintenance(w http.ResponseWriter, req *http.Request) {
+	routing, err := p.routing.Load().route(req.URL.Query().Get("route"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		var c MaintenanceConfig
+		if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := routing.SetMaintenance(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		region, _ := strconv.Atoi(req.URL.Query().Get("region"))
+		if err := routing.RemoveMaintenance(region, req.URL.Query().Get("upstream")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routing.MaintenanceConfigs())
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MirrorBodyLimit is maximum size of request body buffered for mirroring, requests with larger bodies are not mirrored
+var MirrorBodyLimit int64
+
+var mirrorStats = expvar.NewMap("mirror")
+
+const (
+	// Shadow request is abandoned after timeout, so slow shadow pool doesn't pile up requests
+	mirrorTimeout = 30 * time.Second
+	// Requests are not mirrored while so many shadow requests of region are in flight
+	mirrorInflight = 100
+)
+
+// Hop-by-hop headers are not forwarded to shadow pool, as ReverseProxy does for primary one
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Mirror duplicates percent of region requests to shadow pool, shadow responses are discarded
+type Mirror struct {
+	Pool      *Pool
+	Percent   float64
+	bodyLimit int64
+	inflight  chan struct{}
+}
+
+// Creates mirror of region from config
+func (r *Routing) newMirror(region int, c MirrorConfig) (*Mirror, error) {
+	pool, ok := r.Pools[c.Pool]
+	if !ok {
+		return nil, fmt.Errorf("region %d: mirror: unknown pool '%s'", region, c.Pool)
+	}
+	if c.Percent <= 0 || c.Percent > 100 {
+		return nil, fmt.Errorf("region %d: mirror: percent must be in range (0, 100]", region)
+	}
+	return &Mirror{
+		Pool:      pool,
+		Percent:   c.Percent,
+		bodyLimit: MirrorBodyLimit,
+		inflight:  make(chan struct{}, mirrorInflight),
+	}, nil
+}
+
+// Status and latency of primary response
+type mirrorResult struct {
+	status  int
+	latency time.Duration
+}
+
+// Shadow records status of primary response and sends it to shadow request for comparison
+type shadow struct {
+	http.ResponseWriter
+	status  int
+	start   time.Time
+	primary chan mirrorResult
+}
+
+// Starts shadow copy of request if region is mirrored and request is chosen by mirror percent.
+// Request body is buffered, so primary request gets it unchanged. Returns nil if request is not mirrored,
+// otherwise primary response must be written to returned shadow which must be finished by done.
+func (r *Routing) mirror(w http.ResponseWriter, u *Upstream, req *http.Request) *shadow {
+	m, ok := r.mirrors[u.Region]
+	if !ok || rand.Float64()*100 >= m.Percent || req.Header.Get("Upgrade") != "" {
+		return nil
+	}
+	stat := "region." + strconv.Itoa(u.Region) + "."
+	body, ok := m.buffer(req)
+	if !ok {
+		mirrorStats.Add(stat+"skipped", 1)
+		return nil
+	}
+	target := m.Pool.Pick()
+	if target == nil {
+		mirrorStats.Add(stat+"skipped", 1)
+		return nil
+	}
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		mirrorStats.Add(stat+"skipped", 1)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	sreq := req.Clone(ctx)
+	sreq.RequestURI = ""
+	sreq.Body = http.NoBody
+	if body != nil {
+		sreq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	rewriteURL(sreq, target)
+	for _, h := range hopHeaders {
+		sreq.Header.Del(h)
+	}
+	transport := r.poolTransport(m.Pool)
+
+	s := &shadow{ResponseWriter: w, start: time.Now(), primary: make(chan mirrorResult, 1)}
+	go func() {
+		defer func() { <-m.inflight }()
+		defer cancel()
+		start := time.Now()
+		resp, err := transport.RoundTrip(sreq)
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		latency := time.Since(start)
+		primary := <-s.primary
+		mirrorStats.Add(stat+"mirrored", 1)
+		if err != nil {
+			mirrorStats.Add(stat+"errors", 1)
+			log.Printf("[%s] - Error: mirror: %v\n", target.Host, err)
+			return
+		}
+		if resp.StatusCode == primary.status {
+			mirrorStats.Add(stat+"status.match", 1)
+		} else {
+			mirrorStats.Add(stat+"status.mismatch", 1)
+		}
+		mirrorStats.Add(stat+"primary-ms", primary.latency.Milliseconds())
+		mirrorStats.Add(stat+"shadow-ms", latency.Milliseconds())
+	}()
+	return s
+}
+
+// Buffers request body up to limit and restores it for primary request. Returns false
+// if body exceeds limit, primary request gets the whole body anyway.
+func (m *Mirror) buffer(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > m.bodyLimit {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, m.bodyLimit+1))
+	if err != nil || int64(len(buf)) > m.bodyLimit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(buf), req.Body}
+	return buf, true
+}
+
+func (s *shadow) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *shadow) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush and hijack underlying writer
+func (s *shadow) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Passes primary response status and latency to shadow request
+func (s *shadow) done() {
+	s.primary <- mirrorResult{status: s.status, latency: time.Since(s.start)}
+}
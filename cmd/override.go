@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// OverrideHeader is request header which forces client region, e.g. X-Regiond-Region
+	OverrideHeader string
+	// OverrideCookie is cookie which forces client region
+	OverrideCookie string
+	// OverrideQuery is query parameter which forces client region
+	OverrideQuery string
+	// OverrideTrusted holds CIDRs of clients allowed to force region by plain region ID
+	OverrideTrusted []string
+	// OverrideKey is HMAC key of signed override tokens which are accepted from any client
+	OverrideKey   string
+	overrideStats = expvar.NewMap("overrides")
+)
+
+// Override forces client region by request header, cookie or query parameter.
+// Value is either region ID accepted from trusted clients only or signed token
+// in form of 'region.expires.signature' accepted from any client.
+type Override struct {
+	Header  string
+	Cookie  string
+	Query   string
+	Trusted Networks
+	Key     []byte
+}
+
+// NewOverride creates override from flags. Returns nil if no override source is configured.
+func NewOverride() (*Override, error) {
+	if OverrideHeader == "" && OverrideCookie == "" && OverrideQuery == "" {
+		return nil, nil
+	}
+	trusted, err := ParseNetworks(OverrideTrusted)
+	if err != nil {
+		return nil, fmt.Errorf("override trusted: %v", err)
+	}
+	if len(trusted) == 0 && OverrideKey == "" {
+		return nil, fmt.Errorf("override requires trusted CIDRs or signing key")
+	}
+	return &Override{
+		Header:  OverrideHeader,
+		Cookie:  OverrideCookie,
+		Query:   OverrideQuery,
+		Trusted: trusted,
+		Key:     []byte(OverrideKey),
+	}, nil
+}
+
+// Region returns region forced by request of client IP. Sources are checked in order of
+// header, cookie and query parameter. Values which are not allowed for client are ignored.
+func (o *Override) Region(req *http.Request, ip string) (int, bool) {
+	if o == nil {
+		return 0, false
+	}
+	for _, source := range []string{"header", "cookie", "query"} {
+		value := o.value(req, source)
+		if value == "" {
+			continue
+		}
+		region, err := o.verify(value, ip)
+		if err != nil {
+			overrideStats.Add(source+".rejected", 1)
+			log.Printf("[%s] - Error: region override by %s is rejected: %v\n", ip, source, err)
+			continue
+		}
+		overrideStats.Add(source, 1)
+		log.Printf("[%s] - Region is overridden to %d by %s\n", ip, region, source)
+		return region, true
+	}
+	return 0, false
+}
+
+func (o *Override) value(req *http.Request, source string) string {
+	switch source {
+	case "header":
+		if o.Header != "" {
+			return req.Header.Get(o.Header)
+		}
+	case "cookie":
+		if o.Cookie != "" {
+			if c, err := req.Cookie(o.Cookie); err == nil {
+				return c.Value
+			}
+		}
+	case "query":
+		if o.Query != "" {
+			return req.URL.Query().Get(o.Query)
+		}
+	}
+	return ""
+}
+
+// Checks that client is allowed to use override value and returns its region
+func (o *Override) verify(value string, ip string) (int, error) {
+	parts := strings.Split(value, ".")
+	switch len(parts) {
+	case 1:
+		if !o.Trusted.Contains(net.ParseIP(ip)) {
+			return 0, fmt.Errorf("client is not trusted")
+		}
+	case 3:
+		if len(o.Key) == 0 {
+			return 0, fmt.Errorf("signed tokens are not accepted")
+		}
+		expires, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid token expiration")
+		}
+		sig, err := hex.DecodeString(parts[2])
+		if err != nil || !hmac.Equal(sig, overrideSignature(o.Key, parts[0], parts[1])) {
+			return 0, fmt.Errorf("invalid token signature")
+		}
+		if time.Now().Unix() > expires {
+			return 0, fmt.Errorf("token is expired")
+		}
+	default:
+		return 0, fmt.Errorf("invalid value")
+	}
+	region, err := strconv.Atoi(parts[0])
+	if err != nil || region <= 0 {
+		return 0, fmt.Errorf("invalid region '%s'", parts[0])
+	}
+	return region, nil
+}
+
+// SignOverride creates override token for region which expires at the given time
+func SignOverride(key string, region int, expires time.Time) string {
+	r, e := strconv.Itoa(region), strconv.FormatInt(expires.Unix(), 10)
+	return r + "." + e + "." + hex.EncodeToString(overrideSignature([]byte(key), r, e))
+}
+
+func overrideSignature(key []byte, region, expires string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(region + "." + expires))
+	return mac.Sum(nil)
+}
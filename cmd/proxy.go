@@ -1,23 +1,28 @@
 package cmd
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"expvar"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/dddpaul/regiond/cache"
 	_ "github.com/mattn/go-oci8" // Oracle driver
-	"github.com/sebest/xff"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // Env holds datasources and other environment
@@ -26,16 +31,18 @@ type Env struct {
 	Ora *sql.DB
 }
 
-// Upstream represents upstream target with timestamp
+// Upstream represents upstream target with region, pool and timestamp
 type Upstream struct {
 	Target    url.URL   `json:"target"`
+	Region    int       `json:"region"`
+	Pool      string    `json:"pool,omitempty"`
 	Timestamp time.Time `json:"time"`
 }
 
 const df = "2006-01-02 15:04:05 MST"
 
 var (
-	// Upstreams holds list of strings in form of 'host1:port1'
+	// Upstreams holds list of strings in form of 'host1:port1' or 'scheme://host1:port1/base?option=value'
 	Upstreams []string
 	// TTL holds cache record time-to-live in nanoseconds
 	TTL int64
@@ -52,127 +59,378 @@ var (
 				go http.ListenAndServe(":"+strconv.Itoa(metricsPort), nil)
 				log.Printf("Metrics HTTP server is listening on port %d\n", metricsPort)
 			}
-			blt, err := bolt.Open(BoltFn, 0600, nil)
+			env := openEnv()
+			defer env.Close()
+			tlsConfig, err := newServerTLSConfig()
 			if err != nil {
 				log.Fatal(err)
 			}
-			ora, err := sql.Open("oci8", OraConnStr)
+			p := NewMultipleHostProxy(env)
+			if err := p.WatchReload(cmd.Flags()); err != nil {
+				log.Fatal(err)
+			}
+			if AdminAddr != "" {
+				go func() {
+					log.Fatal(http.ListenAndServe(AdminAddr, NewAdminHandler(p)))
+				}()
+				log.Printf("Admin API is listening on %s\n", AdminAddr)
+			}
+			proxy := NewXffProxy(p)
+			ln, err := newListener(port)
 			if err != nil {
 				log.Fatal(err)
 			}
-			defer func() {
-				blt.Close()
-				ora.Close()
+			srv := NewServer(proxy, tlsConfig)
+			go func() {
+				var err error
+				if tlsConfig != nil {
+					log.Printf("TLS is enabled, client auth is '%s'\n", TLSClientAuth)
+					err = srv.ServeTLS(ln, "", "")
+				} else {
+					err = srv.Serve(ln)
+				}
+				if err != http.ErrServerClosed {
+					log.Fatal(err)
+				}
 			}()
-			env := &Env{
-				Blt: blt,
-				Ora: ora,
-			}
-			proxy := NewXffProxy(NewMultipleHostProxy(env))
-			http.ListenAndServe(":"+strconv.Itoa(port), proxy)
+
+			ctx, cancel := waitShutdown()
+			defer cancel()
+			srv.Shutdown(ctx)
+			p.Drain(ctx)
+			p.Close()
 		},
 	}
 )
 
+// Opens Bolt cache and Oracle database
+func openEnv() *Env {
+	blt, err := bolt.Open(BoltFn, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ora, err := sql.Open("oci8", OraConnStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &Env{
+		Blt: blt,
+		Ora: ora,
+	}
+}
+
+// Close closes datasources of environment
+func (env *Env) Close() {
+	env.Blt.Close()
+	env.Ora.Close()
+}
+
+// Waits for SIGINT or SIGTERM and returns context which is done when drain timeout is over
+func waitShutdown() (context.Context, context.CancelFunc) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Shutting down on %v, connections are drained for %v\n", <-stop, DrainTimeout)
+	return context.WithTimeout(context.Background(), DrainTimeout)
+}
+
 func init() {
 	RootCmd.AddCommand(proxyCmd)
-	proxyCmd.PersistentFlags().StringSliceVarP(&Upstreams, "upstreams", "u", nil, "Upstream list in form of 'host1:port1,host2:port2'")
-	proxyCmd.PersistentFlags().Int64VarP(&TTL, "ttl", "t", 3600, "Cache record time-to-live in seconds")
-	proxyCmd.PersistentFlags().StringVarP(&OraConnStr, "oracle", "o", "system/oracle@localhost/xe", "Oracle connection string in form of 'user/pass@host/sid'")
-	proxyCmd.PersistentFlags().StringVarP(&BoltFn, "bolt", "b", "regiond.db", "Bolt caching key-value storage filename")
+	addProxyFlags(proxyCmd.PersistentFlags())
 }
 
-// NewXffProxy wraps reverse proxy with X-Forwarded-For handler
-func NewXffProxy(h http.Handler) http.Handler {
-	xffmw, err := xff.Default()
-	if err != nil {
-		log.Fatal(err)
+// Adds proxy flags, they are shared with config command
+func addProxyFlags(fs *pflag.FlagSet) {
+	addRoutingFlags(fs)
+	fs.StringVarP(&OraConnStr, "oracle", "o", "system/oracle@localhost/xe", "Oracle connection string in form of 'user/pass@host/sid'")
+	fs.DurationVar(&UpgradeIdleTimeout, "upgrade-idle-timeout", 0, "Upgraded connection, e.g. WebSocket, without traffic is closed after this time, zero means no timeout")
+	fs.DurationVar(&DrainTimeout, "drain-timeout", 30*time.Second, "Time requests and upgraded connections are given to finish on shutdown or after removal of their upstream")
+	fs.DurationVar(&ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Time client is given to send request headers, zero means no timeout")
+	fs.DurationVar(&ReadTimeout, "read-timeout", 0, "Time client is given to send the whole request including body, zero means no timeout")
+	fs.DurationVar(&WriteTimeout, "write-timeout", 0, "Time response is given to be written, zero means no timeout")
+	fs.DurationVar(&ClientIdleTimeout, "client-idle-timeout", 2*time.Minute, "Idle keep-alive client connection timeout")
+	fs.IntVar(&MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers in bytes")
+	fs.IntVar(&MaxConns, "max-conns", 0, "Maximum number of concurrent client connections, zero means no limit")
+	fs.StringVar(&AdminAddr, "admin-addr", "", "Address admin API listens on, e.g. 127.0.0.1:9091, admin API is disabled by default")
+	fs.StringVarP(&BoltFn, "bolt", "b", "regiond.db", "Bolt caching key-value storage filename")
+	fs.StringSliceVar(&TrustedProxies, "trusted-proxies", TrustedProxies, "CIDRs of proxies allowed to set Forwarded, X-Forwarded-For and PROXY protocol headers")
+	fs.IntVar(&TrustedHops, "trusted-hops", 0, "Take client address at this position from the right of forwarding chain instead of skipping trusted proxies")
+	fs.BoolVar(&ProxyProtocol, "proxy-protocol", false, "Accept PROXY protocol v1/v2 header from trusted proxies")
+	fs.StringVar(&TLSCert, "tls-cert", "", "TLS certificate filename, enables HTTPS")
+	fs.StringVar(&TLSKey, "tls-key", "", "TLS private key filename")
+	fs.StringVar(&TLSCertDir, "tls-cert-dir", "", "Directory with SNI certificates in form of 'name.crt' and 'name.key' pairs, enables HTTPS")
+	fs.StringVar(&TLSClientCA, "tls-client-ca", "", "CA bundle filename to verify client certificates with")
+	fs.StringVar(&TLSClientAuth, "tls-client-auth", "", "Client certificate policy: 'none', 'request', 'require', 'verify-if-given' or 'verify', default is 'verify' with client CA and 'none' without it")
+}
+
+// Adds flags of settings which may be reloaded without restart
+func addRoutingFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVarP(&Upstreams, "upstreams", "u", nil, "Upstream list in form of 'host1:port1,https://host2:port2/base'")
+	fs.Int64VarP(&TTL, "ttl", "t", 3600, "Cache record time-to-live in seconds")
+	fs.StringVar(&UpstreamTransport.CA, "upstream-ca", "", "CA bundle filename to verify HTTPS upstreams with")
+	fs.StringVar(&UpstreamTransport.Cert, "upstream-cert", "", "Client certificate filename for HTTPS upstreams")
+	fs.StringVar(&UpstreamTransport.Key, "upstream-key", "", "Client private key filename for HTTPS upstreams")
+	fs.StringVar(&UpstreamTransport.ServerName, "upstream-server-name", "", "SNI server name override for HTTPS upstreams")
+	fs.BoolVar(&UpstreamTransport.Insecure, "upstream-insecure", false, "Skip HTTPS upstreams certificate verification")
+	fs.DurationVar(&UpstreamTransport.DialTimeout, "dial-timeout", 30*time.Second, "Upstream connection timeout")
+	fs.DurationVar(&UpstreamTransport.ResponseTimeout, "response-timeout", 0, "Upstream response headers timeout, zero means no timeout")
+	fs.DurationVar(&UpstreamTransport.IdleTimeout, "idle-timeout", 90*time.Second, "Upstream idle connection timeout")
+	fs.DurationVar(&UpstreamTransport.KeepAlive, "keep-alive", 30*time.Second, "Upstream TCP keep-alive period")
+	fs.IntVar(&UpstreamTransport.MaxIdleConns, "max-idle-conns", 0, "Maximum idle connections per upstream, zero means default")
+	fs.StringSliceVarP(&RegionCIDRs, "region-cidrs", "r", nil, "Static region mapping in form of 'cidr1=region1,cidr2=region2', consulted before Oracle")
+	fs.IntVar(&DefaultRegion, "default-region", 0, "Region for clients whose region is not resolved, zero means the first region if Oracle is used and a random one otherwise")
+	fs.IntVar(&IPv6Prefix, "ipv6-prefix", 0, "Prefix length IPv6 clients are bucketed by for stickiness, e.g. 64, zero disables bucketing")
+	fs.StringSliceVar(&RegionLimits, "region-limit", nil, "Per region limits in form of 'region=rate/burst/inflight', '*' region sets default for all regions")
+	fs.StringVar(&ClientLimit, "client-limit", "", "Per client IP limits in form of 'rate/burst/inflight'")
+	fs.StringVar(&DefaultRoute, "default-route", "", "Route for requests matching no route, default regions are used if it is empty and 404 is returned if there are no default regions")
+	fs.DurationVar(&SRVInterval, "srv-interval", 30*time.Second, "Period DNS SRV records of discovered pools are re-resolved with")
+	fs.StringVar(&DNSServer, "dns-server", "", "DNS server address in form of 'host:port' to resolve SRV records with, system resolver is used by default")
+	fs.StringVar(&OverrideHeader, "override-header", "", "Request header which forces client region, e.g. X-Regiond-Region")
+	fs.StringVar(&OverrideCookie, "override-cookie", "", "Cookie which forces client region")
+	fs.StringVar(&OverrideQuery, "override-query", "", "Query parameter which forces client region")
+	fs.StringSliceVar(&OverrideTrusted, "override-trusted", nil, "CIDRs of clients allowed to force region by its ID")
+	fs.StringVar(&OverrideKey, "override-key", "", "HMAC key of signed region override tokens in form of 'region.expires.signature' accepted from any client")
+	fs.StringVar(&AffinityCookie, "affinity-cookie", "", "Name of signed cookie which keeps client upstream regardless of client address and proxy replica")
+	fs.StringSliceVar(&AffinityKeys, "affinity-keys", nil, "HMAC keys of affinity cookie, the first one signs new cookies and all of them verify")
+	fs.Int64Var(&MaxBodySize, "max-body-size", 0, "Maximum size of request body in bytes, routes may override it, zero means no limit")
+	fs.Int64Var(&MirrorBodyLimit, "mirror-body-limit", 1<<20, "Maximum request body size in bytes buffered for mirroring, requests with larger bodies are not mirrored")
+	fs.StringVar(&JWTClaim, "jwt-claim", "", "Claim of verified JWT bearer token clients are routed and cached by instead of IP, e.g. tenant")
+	fs.StringVar(&JWKSFile, "jwks-file", "", "JSON Web Key Set file with RSA, EC or symmetric keys JWT is verified with")
+	fs.StringSliceVar(&JWTKeys, "jwt-keys", nil, "HMAC keys JWT is verified with")
+	fs.StringVar(&APIKeyHeader, "api-key-header", "", "Request header with API key clients are routed and cached by instead of IP, e.g. X-Api-Key")
+	fs.StringVar(&Balance, "balance", "random", "Method upstream is picked from pool with: 'random' or 'least-conn' which counts requests in flight and upgraded connections")
+	fs.StringVar(&HealthPath, "health-path", "", "Path upstreams are checked with, e.g. /health, health checks are disabled if empty")
+	fs.BoolVar(&HealthTCP, "health-tcp", false, "Check upstreams by TCP connect instead of GET of health path, e.g. for tcpproxy")
+	fs.DurationVar(&HealthInterval, "health-interval", 10*time.Second, "Period upstreams are checked with")
+	fs.DurationVar(&HealthTimeout, "health-timeout", 2*time.Second, "Timeout of upstream check")
+	fs.IntVar(&HealthThreshold, "health-threshold", 2, "Number of consecutive checks which change upstream health")
+	fs.StringVar(&ConsulAddr, "consul-addr", "http://127.0.0.1:8500", "Consul HTTP API address for pools discovered by Consul service")
+	fs.StringVar(&EtcdAddr, "etcd-addr", "http://127.0.0.1:2379", "etcd v3 HTTP API address for pools discovered by etcd key prefix")
+}
+
+// Proxy is a reverse proxy which selects upstream by client region
+type Proxy struct {
+	env *Env
+	// Routing may be replaced by reload, so request, connection or query loads it once
+	// and uses the one it was started with
+	routing atomic.Pointer[Routing]
+	rp      *httputil.ReverseProxy
+}
+
+type contextKey int
+
+const (
+	upstreamKey contextKey = iota
+	clientIPKey
+	routingKey
+)
+
+// NewMultipleHostProxy creates a reverse proxy that will select
+// a host from the pool of client region
+func NewMultipleHostProxy(env *Env) *Proxy {
+	p := newProxy(env)
+	routing := p.routing.Load()
+
+	director := func(req *http.Request) {
+		routing := req.Context().Value(routingKey).(*Routing)
+		u := req.Context().Value(upstreamKey).(*Upstream)
+		rewriteURL(req, &u.Target)
+		routing.rewriteRequest(req, u)
+	}
+
+	modifyResponse := func(resp *http.Response) error {
+		routing := resp.Request.Context().Value(routingKey).(*Routing)
+		u := resp.Request.Context().Value(upstreamKey).(*Upstream)
+		routing.rewriteResponse(resp, u)
+		return nil
 	}
-	return xffmw.Handler(h)
+
+	// Request is forwarded with transport of the routing it was started with
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		routing := req.Context().Value(routingKey).(*Routing)
+		u := req.Context().Value(upstreamKey).(*Upstream)
+		pool, ok := routing.Pools[u.Pool]
+		if !ok {
+			pool = routing.Regions[u.Region]
+		}
+		resp, err := routing.poolTransport(pool).RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+			return resp, err
+		}
+		if body, ok := resp.Body.(io.ReadWriteCloser); ok {
+			resp.Body = p.trackUpgrade(u.Target, body)
+		}
+		return resp, nil
+	})
+
+	log.Printf("Reverse proxy is listening on port %d for %d regions and %d routes with TTL %d seconds", port, len(routing.Regions), len(routing.Routes), routing.TTL)
+	p.rp = &httputil.ReverseProxy{Director: director, Transport: transport, ModifyResponse: modifyResponse, ErrorHandler: proxyError}
+	return p
 }
 
-// NewMultipleHostProxy creates a reverse proxy that will randomly
-// select a host from the passed `targets`
-func NewMultipleHostProxy(env *Env) *httputil.ReverseProxy {
+// Creates proxy core with routing and cache which is shared by HTTP and TCP proxies
+func newProxy(env *Env) *Proxy {
 	if env.Blt != nil {
 		cache.Create(env.Blt)
 	}
-	targets := toUrls(Upstreams)
+	routing, err := NewRouting(env)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &Proxy{env: env}
+	p.routing.Store(routing)
+	return p
+}
 
-	director := func(req *http.Request) {
-		ip := strings.Split(req.RemoteAddr, ":")[0]
-
-		// Prepare statement here to be able to close it by defer in case of database unavailability.
-		// Do not move it below "if upstream == nil" because there will be now reconnections will be disabled.
-		var stmt *sql.Stmt
-		var err error
-		if env.Ora != nil {
-			stmt, err = env.Ora.Prepare("SELECT region FROM ip_to_region WHERE rownum = 1 AND ip = :1")
-			if err != nil {
-				log.Printf("[%s] - Error: %v\n", ip, err)
-			}
-			if stmt != nil {
-				// May be nil when database is unavailable
-				defer stmt.Close()
-			}
-			oraOpenConns.Set(int64(env.Ora.Stats().OpenConnections))
-		}
+// Close stops background update of routing
+func (p *Proxy) Close() {
+	p.routing.Load().Close()
+}
 
-		var u *Upstream
-		if env.Blt != nil {
-			u = getUpstreamFromCache(ip, env)
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	routing := p.routing.Load().Route(req)
+	if routing == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if !routing.limitBody(w, req) {
+		return
+	}
+	ip := CanonicalIP(ClientIP(req))
+	// Client is cached by its identity if request has one and by IP otherwise
+	identity, key := routing.Identity.Key(req, ip, routing.identities)
+	if identity == "" {
+		key = ClientKey(ip, routing.IPv6Prefix)
+	}
+	key = routing.cacheKey(key)
+	u := p.overridden(routing, req, ip, key)
+	if u == nil {
+		u = routing.Affinity.Upstream(req, routing)
+	}
+	if u == nil {
+		if u = p.upstream(routing, identity, ip, key); u != nil {
+			routing.Affinity.SetCookie(w, req, routing, u)
 		}
-		if u == nil {
-			u = &Upstream{
-				Target:    *LoadBalance(targets, ip, stmt),
-				Timestamp: time.Now(),
-			}
-			if env.Blt != nil {
-				encoded, err := json.Marshal(u)
-				if err != nil {
-					log.Printf("[%s] - Error: %v\n", ip, err)
-				}
-				cache.Put(env.Blt, ip, encoded)
-				log.Printf("Upstream [%v] with timestamp [%s] for [%s] is cached", u.Target.Host, u.Timestamp.Format(df), ip)
-			}
+	}
+	if u == nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if resp := routing.ACL.Check(u.Region, ip, req.URL.Path); resp != nil {
+		resp.serve(w, req)
+		return
+	}
+	if f := routing.failover(u, key); f != nil {
+		u = f
+	}
+	if m := routing.underMaintenance(u); m != nil {
+		fallback := m.fallback(routing, key)
+		if fallback == nil {
+			maintenanceStats.Add("region."+strconv.Itoa(u.Region)+".served", 1)
+			m.serve(w, req)
+			return
 		}
+		maintenanceStats.Add("region."+strconv.Itoa(u.Region)+".fallback", 1)
+		u = fallback
+	}
+	routing.countSplit(u)
+	// Redirected clients don't reach upstreams, so they are not limited
+	if location, status := routing.redirect(u, req); location != "" {
+		http.Redirect(w, req, location, status)
+		return
+	}
 
-		req.URL.Scheme = u.Target.Scheme
-		req.URL.Host = u.Target.Host
-		req.URL.Path = singleJoiningSlash(u.Target.Path, req.URL.Path)
+	// Client is limited by IP, and its limit is shared by all routes
+	release, retryAfter := routing.Limiter.Acquire(u.Region, ClientKey(ip, routing.IPv6Prefix))
+	if release == nil {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
 	}
+	defer release()
+
+	if s := routing.mirror(w, u, req); s != nil {
+		w = s
+		defer s.done()
+	}
+
+	// Request or upgraded connection, e.g. WebSocket, is counted until it is finished
+	defer upstreamConns.acquire(u.Target.Host)()
 
-	log.Printf("Reverse proxy is listening on port %d for upstreams %v with TTL %d seconds", port, targets, TTL)
-	return &httputil.ReverseProxy{Director: director}
+	ctx := context.WithValue(req.Context(), upstreamKey, u)
+	ctx = context.WithValue(ctx, routingKey, routing)
+	p.rp.ServeHTTP(w, req.WithContext(ctx))
 }
 
-// LoadBalance defines balancing logic.
-// Returns upstream based on value from Oracle table.
-func LoadBalance(targets []*url.URL, ip string, stmt *sql.Stmt) *url.URL {
-	// Returns random upstream if statement is not prepared
-	if stmt == nil {
-		return targets[rand.Int()%len(targets)]
-	}
+// Returns upstream for client from cache by key or selects it from the pool of client region
+// resolved by client identity or IP. Cached upstream is ignored if it was removed from region pool
+// by reload. Returns nil if region has no upstreams.
+func (p *Proxy) upstream(routing *Routing, identity string, ip string, key string) *Upstream {
+	env := p.env
 
-	var region int
-	err := stmt.QueryRow(ip).Scan(&region)
-	if err != nil {
-		log.Printf("[%s] - Error: %v\n", ip, err)
-		// Use first upstream on error
-		return targets[0]
+	var u *Upstream
+	if env.Blt != nil {
+		u = getUpstreamFromCache(key, env, routing.TTL)
+		if u != nil && !routing.Contains(u.Region, key, &u.Target) {
+			u = nil
+		}
+		// Upstreams cached by previous versions have no pool
+		if u != nil && u.Pool == "" {
+			u.Pool = routing.Pool(u.Region, key).Name
+		}
+	}
+	if u == nil {
+		region := routing.Region(identity, ip)
+		target, pool := routing.Target(region, key)
+		if target == nil {
+			log.Printf("[%s] - Error: no upstreams for region %d\n", ip, region)
+			return nil
+		}
+		u = &Upstream{
+			Target:    *target,
+			Region:    region,
+			Pool:      pool,
+			Timestamp: time.Now(),
+		}
+		if env.Blt != nil {
+			encoded, err := json.Marshal(u)
+			if err != nil {
+				log.Printf("[%s] - Error: %v\n", ip, err)
+			}
+			cache.Put(env.Blt, key, encoded)
+			log.Printf("Upstream [%v] with timestamp [%s] for [%s] is cached", u.Target.Host, u.Timestamp.Format(df), key)
+		}
 	}
+	return u
+}
 
-	return targets[region-1]
+// Returns upstream of region forced by request, nil if region is not overridden or has no upstreams.
+// Overridden upstream is neither taken from cache nor cached.
+func (p *Proxy) overridden(routing *Routing, req *http.Request, ip string, key string) *Upstream {
+	region, ok := routing.Override.Region(req, ip)
+	if !ok {
+		return nil
+	}
+	target, pool := routing.Target(region, key)
+	if target == nil {
+		log.Printf("[%s] - Error: no upstreams for overridden region %d\n", ip, region)
+		return nil
+	}
+	return &Upstream{
+		Target:    *target,
+		Region:    region,
+		Pool:      pool,
+		Timestamp: time.Now(),
+	}
 }
 
 // Fetch upstream from cache. Return nil if upstream is not found or expired.
-func getUpstreamFromCache(ip string, env *Env) *Upstream {
+func getUpstreamFromCache(ip string, env *Env, ttl int64) *Upstream {
 	var u *Upstream
 	if byt := cache.Get(env.Blt, ip); byt != nil {
 		if err := json.Unmarshal(byt, &u); err != nil {
 			log.Printf("[%s] - Error: %v\n", ip, err)
 		}
-		if u.Timestamp.Add(time.Duration(TTL) * time.Second).After(time.Now()) {
+		if u.Timestamp.Add(time.Duration(ttl) * time.Second).After(time.Now()) {
 			// log.Printf("Upstream [%v] with timestamp [%s] for [%s] is found in cache\n", u.Target.Host, u.Timestamp.Format(df), ip)
 		} else {
 			// Upstream record in cache is too old
@@ -183,16 +441,16 @@ func getUpstreamFromCache(ip string, env *Env) *Upstream {
 	return u
 }
 
-// Converts list of upstreams to the list of URLs
-func toUrls(upstreams []string) []*url.URL {
-	var urls []*url.URL
-	for _, upstream := range upstreams {
-		urls = append(urls, &url.URL{
-			Scheme: "http",
-			Host:   upstream,
-		})
+// Points request URL to upstream target
+func rewriteURL(req *http.Request, target *url.URL) {
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
 	}
-	return urls
 }
 
 // Taken from net/http/httputil/reverseproxy.go
@@ -207,3 +465,27 @@ func singleJoiningSlash(a, b string) string {
 	}
 	return a + b
 }
+
+// Taken from net/http/httputil/reverseproxy.go, keeps escaped slashes of both paths
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
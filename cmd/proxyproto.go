@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol v2 signature
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Timeout for reading PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// ProxyProtoListener accepts connections with PROXY protocol v1/v2 header from trusted proxies.
+// Connections from other peers are passed as is.
+type ProxyProtoListener struct {
+	net.Listener
+	Trusted Networks
+}
+
+// Accept waits for the next connection. Header is read lazily in connection goroutine.
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && !l.Trusted.Contains(addr.IP) {
+		return c, nil
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	r       *bufio.Reader
+	once    sync.Once
+	err     error
+	srcAddr net.Addr
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.srcAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.srcAddr != nil {
+		return c.srcAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Reads PROXY protocol header. Returns nil address for LOCAL and UNKNOWN connections.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err == nil && bytes.Equal(sig, proxyV2Sig) {
+		return readProxyHeaderV2(r)
+	}
+	sig, err = r.Peek(6)
+	if err == nil && string(sig) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	return nil, fmt.Errorf("PROXY protocol header is missing")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// Maximum header length is 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, fmt.Errorf("PROXY v1 header is too long")
+	}
+	fields := strings.Fields(s)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", s)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", s)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 {
+		// LOCAL command, connection is established by proxy itself
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Unspecified or unix address family
+	return nil, nil
+}
+
+// Creates TCP listener on port with limit of concurrent connections, PROXY protocol header is accepted if it is enabled
+func newListener(port int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	ln = LimitListener(ln, MaxConns)
+	if !ProxyProtocol {
+		return ln, nil
+	}
+	trusted, err := ParseNetworks(TrustedProxies)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &ProxyProtoListener{Listener: ln, Trusted: trusted}, nil
+}
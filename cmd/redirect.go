@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var redirectStats = expvar.NewMap("redirect")
+
+// Redirect sends region clients to region base URL instead of proxying their requests
+type Redirect struct {
+	URL     *url.URL
+	Status  int
+	Paths   []string
+	Methods map[string]bool
+}
+
+func (r *Routing) newRedirect(region int, c RedirectConfig) (*Redirect, error) {
+	target, err := url.Parse(c.URL)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("region %d: redirect: invalid URL '%s'", region, c.URL)
+	}
+	status := c.Status
+	switch status {
+	case 0:
+		status = http.StatusFound
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("region %d: redirect: invalid status %d", region, c.Status)
+	}
+	methods := c.Methods
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD"}
+	}
+	redirect := &Redirect{URL: target, Status: status, Methods: make(map[string]bool)}
+	for _, path := range c.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("region %d: redirect: path must start with '/'", region)
+		}
+		redirect.Paths = append(redirect.Paths, strings.TrimSuffix(path, "/"))
+	}
+	for _, method := range methods {
+		redirect.Methods[strings.ToUpper(method)] = true
+	}
+	return redirect, nil
+}
+
+// Returns location and status client of upstream region is redirected with, empty location if
+// request is proxied. Upgrade requests are always proxied.
+func (r *Routing) redirect(u *Upstream, req *http.Request) (string, int) {
+	rd, ok := r.redirects[u.Region]
+	if !ok || !rd.Methods[req.Method] || req.Header.Get("Upgrade") != "" {
+		return "", 0
+	}
+	if len(rd.Paths) > 0 {
+		matched := false
+		for _, prefix := range rd.Paths {
+			if hasPathPrefix(req.URL.Path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", 0
+		}
+	}
+	location := *rd.URL
+	location.Path, location.RawPath = joinURLPath(rd.URL, req.URL)
+	if rd.URL.RawQuery == "" || req.URL.RawQuery == "" {
+		location.RawQuery = rd.URL.RawQuery + req.URL.RawQuery
+	} else {
+		location.RawQuery = rd.URL.RawQuery + "&" + req.URL.RawQuery
+	}
+	redirectStats.Add("region."+strconv.Itoa(u.Region)+".redirected", 1)
+	return location.String(), rd.Status
+}
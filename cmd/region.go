@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// RegionCIDRs holds static region mapping in form of 'cidr=region', it is consulted before Oracle table
+	RegionCIDRs []string
+	// IPv6Prefix is a prefix length IPv6 clients are bucketed by for stickiness, zero disables bucketing
+	IPv6Prefix int
+)
+
+type regionNet struct {
+	net    *net.IPNet
+	region int
+}
+
+// RegionTable maps client networks to regions, the most specific network wins
+type RegionTable []regionNet
+
+// ParseRegionTable parses list of mappings in form of 'cidr=region'
+func ParseRegionTable(entries []string) (RegionTable, error) {
+	var t RegionTable
+	for _, e := range entries {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("region mapping %s: must be in form of 'cidr=region'", e)
+		}
+		nets, err := ParseNetworks([]string{kv[0]})
+		if err != nil {
+			return nil, fmt.Errorf("region mapping %s: %v", e, err)
+		}
+		region, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("region mapping %s: region: %v", e, err)
+		}
+		t = append(t, regionNet{net: nets[0], region: region})
+	}
+	sort.SliceStable(t, func(i, j int) bool {
+		oi, _ := t[i].net.Mask.Size()
+		oj, _ := t[j].net.Mask.Size()
+		return oi > oj
+	})
+	return t, nil
+}
+
+// Lookup returns region of the most specific network containing IP
+func (t RegionTable) Lookup(ip net.IP) (int, bool) {
+	if ip == nil {
+		return 0, false
+	}
+	for _, rn := range t {
+		if rn.net.Contains(ip) {
+			return rn.region, true
+		}
+	}
+	return 0, false
+}
+
+// CanonicalIP returns canonical text form of IP, IPv4-mapped IPv6 addresses are converted to IPv4.
+// Input is returned as is if it is not an IP.
+func CanonicalIP(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
+
+// ClientKey returns cache key for client IP. IPv6 clients are bucketed by prefix if it is set,
+// so all addresses of the same network stick to the same upstream.
+func ClientKey(s string, v6prefix int) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	if ip.To4() != nil || v6prefix <= 0 || v6prefix >= 128 {
+		return ip.String()
+	}
+	n := &net.IPNet{IP: ip.Mask(net.CIDRMask(v6prefix, 128)), Mask: net.CIDRMask(v6prefix, 128)}
+	return n.String()
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var reloadMu sync.Mutex
+
+// Settings which may be changed by reload
+type routingSettings struct {
+	upstreams     []string
+	ttl           int64
+	transport     TransportOptions
+	regionCIDRs   []string
+	defaultRegion int
+	ipv6Prefix    int
+	regionLimits  []string
+	clientLimit   string
+	srvInterval   time.Duration
+	dnsServer     string
+	consulAddr    string
+	etcdAddr      string
+	overrideHdr   string
+	overrideCook  string
+	overrideQuery string
+	overrideTrust []string
+	overrideKey   string
+	affinity      string
+	affinityKeys  []string
+	mirrorLimit   int64
+	maxBodySize   int64
+	jwtClaim      string
+	jwksFile      string
+	jwtKeys       []string
+	apiKeyHeader  string
+	balance       string
+	healthPath    string
+	healthTCP     bool
+	healthIntvl   time.Duration
+	healthTimeout time.Duration
+	healthThresh  int
+	pools         map[string]PoolConfig
+	regions       []RegionConfig
+	resolvers     []ResolverConfig
+	routes        []RouteConfig
+	access        []AccessConfig
+	maintenance   []MaintenanceConfig
+	headers       HeadersConfig
+	defaultRoute  string
+}
+
+func saveRoutingSettings() routingSettings {
+	return routingSettings{
+		upstreams:     Upstreams,
+		ttl:           TTL,
+		transport:     UpstreamTransport,
+		regionCIDRs:   RegionCIDRs,
+		defaultRegion: DefaultRegion,
+		ipv6Prefix:    IPv6Prefix,
+		regionLimits:  RegionLimits,
+		clientLimit:   ClientLimit,
+		srvInterval:   SRVInterval,
+		dnsServer:     DNSServer,
+		consulAddr:    ConsulAddr,
+		etcdAddr:      EtcdAddr,
+		overrideHdr:   OverrideHeader,
+		overrideCook:  OverrideCookie,
+		overrideQuery: OverrideQuery,
+		overrideTrust: OverrideTrusted,
+		overrideKey:   OverrideKey,
+		affinity:      AffinityCookie,
+		affinityKeys:  AffinityKeys,
+		mirrorLimit:   MirrorBodyLimit,
+		maxBodySize:   MaxBodySize,
+		jwtClaim:      JWTClaim,
+		jwksFile:      JWKSFile,
+		jwtKeys:       JWTKeys,
+		apiKeyHeader:  APIKeyHeader,
+		balance:       Balance,
+		healthPath:    HealthPath,
+		healthTCP:     HealthTCP,
+		healthIntvl:   HealthInterval,
+		healthTimeout: HealthTimeout,
+		healthThresh:  HealthThreshold,
+		pools:         Pools,
+		regions:       RegionConfigs,
+		resolvers:     ResolverConfigs,
+		routes:        RouteConfigs,
+		access:        AccessConfigs,
+		maintenance:   MaintenanceConfigs,
+		headers:       Headers,
+		defaultRoute:  DefaultRoute,
+	}
+}
+
+func (s routingSettings) restore() {
+	Upstreams = s.upstreams
+	TTL = s.ttl
+	UpstreamTransport = s.transport
+	RegionCIDRs = s.regionCIDRs
+	DefaultRegion = s.defaultRegion
+	IPv6Prefix = s.ipv6Prefix
+	RegionLimits = s.regionLimits
+	ClientLimit = s.clientLimit
+	SRVInterval = s.srvInterval
+	DNSServer = s.dnsServer
+	ConsulAddr = s.consulAddr
+	EtcdAddr = s.etcdAddr
+	OverrideHeader = s.overrideHdr
+	OverrideCookie = s.overrideCook
+	OverrideQuery = s.overrideQuery
+	OverrideTrusted = s.overrideTrust
+	OverrideKey = s.overrideKey
+	AffinityCookie = s.affinity
+	AffinityKeys = s.affinityKeys
+	MirrorBodyLimit = s.mirrorLimit
+	MaxBodySize = s.maxBodySize
+	JWTClaim = s.jwtClaim
+	JWKSFile = s.jwksFile
+	JWTKeys = s.jwtKeys
+	APIKeyHeader = s.apiKeyHeader
+	Balance = s.balance
+	HealthPath = s.healthPath
+	HealthTCP = s.healthTCP
+	HealthInterval = s.healthIntvl
+	HealthTimeout = s.healthTimeout
+	HealthThreshold = s.healthThresh
+	Pools = s.pools
+	RegionConfigs = s.regions
+	ResolverConfigs = s.resolvers
+	RouteConfigs = s.routes
+	AccessConfigs = s.access
+	MaintenanceConfigs = s.maintenance
+	Headers = s.headers
+	DefaultRoute = s.defaultRoute
+}
+
+// Reload re-reads config file and environment, then atomically replaces upstream pools,
+// regions, resolvers, TTL and limits. Flags specified on command line keep their values.
+// Current routing is kept if new config is invalid. Requests in flight are finished
+// with the routing they were started with.
+func (p *Proxy) Reload(cli *pflag.FlagSet) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	saved := saveRoutingSettings()
+	// Fresh flag set resets settings to defaults
+	fs := pflag.NewFlagSet("reload", pflag.ContinueOnError)
+	addRoutingFlags(fs)
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if orig := cli.Lookup(f.Name); err == nil && orig != nil && orig.Changed {
+			err = fs.Set(f.Name, strings.Trim(orig.Value.String(), "[]"))
+		}
+	})
+	if err == nil {
+		err = ApplyConfig(fs)
+	}
+	var routing *Routing
+	if err == nil {
+		routing, err = NewRouting(p.env)
+	}
+	if err != nil {
+		saved.restore()
+		return err
+	}
+
+	old := p.routing.Swap(routing)
+	old.Close()
+	log.Printf("Config is reloaded, %d regions with TTL %d seconds\n", len(routing.Regions), routing.TTL)
+	return nil
+}
+
+// WatchReload reloads proxy on SIGHUP and on config file change
+func (p *Proxy) WatchReload(cli *pflag.FlagSet) error {
+	reload := func(reason string) {
+		log.Printf("Reloading config on %s\n", reason)
+		if err := p.Reload(cli); err != nil {
+			log.Printf("Config is not reloaded, current one is kept: %v\n", err)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			reload("SIGHUP")
+		}
+	}()
+
+	fn := viper.ConfigFileUsed()
+	if fn == "" {
+		return nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch directory instead of file because config is usually replaced by renaming
+	if err := w.Add(filepath.Dir(fn)); err != nil {
+		w.Close()
+		return err
+	}
+	go func() {
+		var changed <-chan time.Time
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == filepath.Clean(fn) {
+					changed = time.After(reloadDelay)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v\n", err)
+			case <-changed:
+				changed = nil
+				reload("config file change")
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// DefaultOracleQuery selects region by client IP
+const DefaultOracleQuery = "SELECT region FROM ip_to_region WHERE rownum = 1 AND ip = :1"
+
+// ErrRegionNotFound is returned by resolver which has no region for client
+var ErrRegionNotFound = errors.New("region is not found")
+
+// Resolver resolves region of client by its IP or identity
+type Resolver interface {
+	Resolve(ip string) (int, error)
+}
+
+// Resolve implements Resolver by looking up client IP in the table
+func (t RegionTable) Resolve(ip string) (int, error) {
+	if region, ok := t.Lookup(net.ParseIP(ip)); ok {
+		return region, nil
+	}
+	return 0, ErrRegionNotFound
+}
+
+// IdentityTable maps client identities, e.g. JWT claim values, to regions
+type IdentityTable map[string]int
+
+// Resolve implements Resolver by looking up client identity in the table
+func (t IdentityTable) Resolve(client string) (int, error) {
+	if region, ok := t[client]; ok {
+		return region, nil
+	}
+	return 0, ErrRegionNotFound
+}
+
+// OracleResolver resolves region by query to Oracle database
+type OracleResolver struct {
+	DB    *sql.DB
+	Query string
+}
+
+// Resolve implements Resolver
+func (r *OracleResolver) Resolve(ip string) (int, error) {
+	// Prepare statement on every lookup to be able to close it in case of database unavailability
+	stmt, err := r.DB.Prepare(r.Query)
+	oraOpenConns.Set(int64(r.DB.Stats().OpenConnections))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var region int
+	if err := stmt.QueryRow(ip).Scan(&region); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrRegionNotFound
+		}
+		return 0, err
+	}
+	return region, nil
+}
+
+// Resolvers are tried in order until region is found
+type Resolvers []Resolver
+
+// Resolve implements Resolver. The last error is returned if region is not found.
+func (rs Resolvers) Resolve(ip string) (int, error) {
+	err := ErrRegionNotFound
+	for _, r := range rs {
+		var region int
+		if region, err = r.Resolve(ip); err == nil {
+			return region, nil
+		}
+		if err != ErrRegionNotFound {
+			log.Printf("[%s] - Error: %v\n", ip, err)
+		}
+	}
+	return 0, err
+}
+
+// Creates resolvers chain from config. Static and Oracle resolvers are used by default.
+// Oracle resolver is skipped if database is not available in environment.
+func newResolvers(configs []ResolverConfig, table RegionTable, identities IdentityTable, env *Env) (Resolvers, error) {
+	if len(configs) == 0 {
+		configs = []ResolverConfig{{Type: "static"}, {Type: "oracle"}}
+	}
+	var rs Resolvers
+	for _, c := range configs {
+		switch c.Type {
+		case "static":
+			rs = append(rs, table)
+			if len(identities) > 0 {
+				rs = append(rs, identities)
+			}
+		case "oracle":
+			if env.Ora == nil {
+				continue
+			}
+			query := c.Query
+			if query == "" {
+				query = DefaultOracleQuery
+			}
+			rs = append(rs, &OracleResolver{DB: env.Ora, Query: query})
+		default:
+			return nil, fmt.Errorf("unknown resolver type '%s'", c.Type)
+		}
+	}
+	return rs, nil
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -16,6 +17,9 @@ var metricsPort int
 var RootCmd = &cobra.Command{
 	Use:   "regiond",
 	Short: "Region based HTTP proxy",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return ApplyConfig(cmd.Flags())
+	},
 }
 
 // Execute adds all child commands to the root command sets flags appropriately.
@@ -29,10 +33,14 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
-	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.regiond.yaml)")
+	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file in YAML, TOML, HCL or JSON format (default is $HOME/.regiond.yaml)")
 	RootCmd.PersistentFlags().IntVarP(&port, "port", "p", 9090, "port on which the server will listen")
 	RootCmd.PersistentFlags().IntVarP(&metricsPort, "metrics-port", "m", 0, "port on which metrics will be exposed")
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	viper.SetEnvPrefix("regiond") // environment variables are in form of REGIOND_UPSTREAM_CA
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv() // read in environment variables that match
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -40,14 +48,17 @@ func initConfig() {
 	if cfgFile != "" {
 		// enable ability to specify config file via flag
 		viper.SetConfigFile(cfgFile)
+	} else {
+		viper.SetConfigName(".regiond") // name of config file (without extension)
+		viper.AddConfigPath("$HOME")    // adding home directory as first search path
 	}
 
-	viper.SetConfigName(".regiond") // name of config file (without extension)
-	viper.AddConfigPath("$HOME")    // adding home directory as first search path
-	viper.AutomaticEnv()            // read in environment variables that match
-
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	} else if cfgFile != "" {
+		// Explicitly specified config file must exist and be valid
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfigLoad)
 	}
 }
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultRoute is name of route for requests matching no route. If it is empty, such requests
+// are routed by default regions, or get 404 if there are no default regions.
+var DefaultRoute string
+
+// Creates routing of virtual host and path which shares pools and transports with default routing
+func (r *Routing) newRoute(c RouteConfig, env *Env) (*Routing, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("route name is empty")
+	}
+	host := strings.ToLower(c.Host)
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return nil, fmt.Errorf("route %s: wildcard host must be in form of '*.domain'", c.Name)
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return nil, fmt.Errorf("route %s: path must start with '/'", c.Name)
+	}
+	route := &Routing{
+		Name:       c.Name,
+		Host:       host,
+		Path:       strings.TrimSuffix(c.Path, "/"),
+		Pools:      r.Pools,
+		Regions:    make(map[int]*Pool),
+		Transport:  r.Transport,
+		dialer:     r.dialer,
+		Override:   r.Override,
+		Affinity:   r.Affinity,
+		Identity:   r.Identity,
+		ACL:        r.ACL,
+		TTL:        r.TTL,
+		IPv6Prefix: r.IPv6Prefix,
+		maxBody:    r.maxBody,
+		fallback:   c.DefaultRegion,
+		splits:     make(map[int][]Split),
+		mirrors:    make(map[int]*Mirror),
+		redirects:  make(map[int]*Redirect),
+		failovers:  make(map[int][]int),
+		records:    make(map[int]dnsRecords),
+	}
+	if c.TTL > 0 {
+		route.TTL = c.TTL
+	}
+	if c.MaxBodySize != 0 {
+		route.maxBody = c.MaxBodySize
+	}
+	route.headers = r.headers
+	if c.Headers != nil {
+		if err := c.Headers.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: %v", c.Name, err)
+		}
+		route.headers = append(route.headers[:len(route.headers):len(route.headers)], *c.Headers)
+	}
+	if err := route.setRegions(c.Regions, nil, c.Resolvers, env); err != nil {
+		return nil, fmt.Errorf("route %s: %v", c.Name, err)
+	}
+	return route, nil
+}
+
+// Route selects routing of request by host and path prefix. Exact host is preferred to wildcard one,
+// wildcard host to any host, and longer path prefix to shorter one. Returns nil if request matches no route.
+func (r *Routing) Route(req *http.Request) *Routing {
+	host := strings.ToLower(hostOnly(req.Host))
+	var route *Routing
+	best := -1
+	for _, candidate := range r.Routes {
+		specificity := candidate.matchHost(host)
+		if specificity < 0 || !candidate.matchPath(req.URL.Path) {
+			continue
+		}
+		if score := specificity<<16 + len(candidate.Path); score > best {
+			route, best = candidate, score
+		}
+	}
+	if route == nil {
+		return r.unmatched
+	}
+	return route
+}
+
+// Returns 2 for exact host match, 1 for wildcard match, 0 if route has no host and -1 if host doesn't match
+func (r *Routing) matchHost(host string) int {
+	switch {
+	case r.Host == "":
+		return 0
+	case r.Host == host:
+		return 2
+	case strings.HasPrefix(r.Host, "*.") && strings.HasSuffix(host, r.Host[1:]):
+		return 1
+	}
+	return -1
+}
+
+func (r *Routing) matchPath(path string) bool {
+	return hasPathPrefix(path, r.Path)
+}
+
+// Path prefix without trailing slash matches whole path segments only, e.g. '/api' matches '/api/users'
+// but not '/apis'. Empty prefix matches any path.
+func hasPathPrefix(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Returns cache key of client in routing, keys of named routes are prefixed to keep clients of different routes apart
+func (r *Routing) cacheKey(key string) string {
+	if r.Name == "" {
+		return key
+	}
+	return r.Name + "@" + key
+}
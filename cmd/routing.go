@@ -0,0 +1,579 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultRegion is assigned to clients whose region is not resolved.
+// Zero means the first region if Oracle is used and a random region otherwise.
+var DefaultRegion int
+
+// Pool is a named group of interchangeable upstreams.
+// Targets of pool discovered by DNS SRV records or service registry are updated in background.
+type Pool struct {
+	Name string
+	// Transport is used for targets of discovered pool, routing transports are used if it is nil
+	Transport http.RoundTripper
+	// LeastConn picks upstream with the least connections instead of random one
+	LeastConn bool
+	mu        sync.RWMutex
+	targets   []*url.URL
+	weights   []int
+	// Priorities of targets, lower ones are preferred. Nil priorities mean equal ones.
+	priorities []int
+	down       map[string]bool
+	stop       chan struct{}
+}
+
+// NewPool creates pool with static targets
+func NewPool(name string, targets []*url.URL) *Pool {
+	return &Pool{Name: name, targets: targets}
+}
+
+// Targets returns current upstreams of pool
+func (p *Pool) Targets() []*url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.targets
+}
+
+// SetTargets replaces upstreams of pool. Targets are picked with probability proportional
+// to their weights, zero weight targets are picked only if there are no other ones. Nil weights mean equal ones.
+func (p *Pool) SetTargets(targets []*url.URL, weights []int) {
+	p.setTargets(targets, weights, nil)
+}
+
+// Replaces upstreams of pool, targets of higher priority are picked only if there are no ones of lower priority
+func (p *Pool) setTargets(targets []*url.URL, weights []int, priorities []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets, p.weights, p.priorities = targets, weights, priorities
+}
+
+// Pick selects random upstream from pool, healthy upstreams are preferred to unhealthy ones.
+// Returns nil if pool is empty.
+func (p *Pool) Pick() *url.URL {
+	if target := p.PickAvailable(nil); target != nil {
+		return target
+	}
+	return p.pick(func(*url.URL) bool { return true })
+}
+
+// PickAvailable selects random healthy upstream accepted by filter, nil filter accepts any upstream.
+// Returns nil if there is no such upstream.
+func (p *Pool) PickAvailable(accept func(*url.URL) bool) *url.URL {
+	return p.pick(func(t *url.URL) bool {
+		return !p.down[t.String()] && (accept == nil || accept(t))
+	})
+}
+
+// Selects random upstream accepted by filter with probability proportional to its weight.
+// Only accepted upstreams of the lowest priority are selected, zero weight ones are selected
+// equally if all of them have zero weight.
+func (p *Pool) pick(accept func(*url.URL) bool) *url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	accepted := make([]bool, len(p.targets))
+	priority, found := 0, false
+	for i, t := range p.targets {
+		if accepted[i] = accept(t); accepted[i] && (!found || p.priority(i) < priority) {
+			priority, found = p.priority(i), true
+		}
+	}
+	if !found {
+		return nil
+	}
+	weights := make([]int, len(p.targets))
+	total := 0
+	for i := range p.targets {
+		if accepted[i] && p.priority(i) == priority {
+			weights[i] = 1
+			if p.weights != nil {
+				weights[i] = p.weights[i]
+			}
+			total += weights[i]
+		}
+	}
+	if total == 0 {
+		for i := range p.targets {
+			if accepted[i] && p.priority(i) == priority {
+				weights[i] = 1
+				total++
+			}
+		}
+	}
+	if p.LeastConn {
+		return p.leastConn(weights)
+	}
+	n := rand.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			return p.targets[i]
+		}
+		n -= w
+	}
+	return nil
+}
+
+// Returns priority of target, must be called with pool mutex held
+func (p *Pool) priority(i int) int {
+	if p.priorities == nil {
+		return 0
+	}
+	return p.priorities[i]
+}
+
+// Selects upstream with the least connections per weight, ties are broken randomly.
+// Must be called with pool mutex held.
+func (p *Pool) leastConn(weights []int) *url.URL {
+	var best []int
+	bestConns, bestWeight := 0, 1
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		conns := upstreamConns.Active(p.targets[i].Host)
+		switch {
+		case best == nil || conns*bestWeight < bestConns*w:
+			best, bestConns, bestWeight = []int{i}, conns, w
+		case conns*bestWeight == bestConns*w:
+			best = append(best, i)
+		}
+	}
+	return p.targets[best[rand.Intn(len(best))]]
+}
+
+// Close stops background update of pool targets
+func (p *Pool) Close() {
+	if p.stop != nil {
+		close(p.stop)
+	}
+}
+
+// Routing holds pools, regions and resolvers requests are routed with.
+// Routes are routings of virtual hosts and paths which share pools with the default one.
+type Routing struct {
+	Name       string
+	Host       string
+	Path       string
+	Pools      map[string]*Pool
+	Regions    map[int]*Pool
+	Resolver   Resolver
+	Transport  UpstreamTransports
+	dialer     *net.Dialer
+	Limiter    *Limiter
+	Override   *Override
+	Affinity   *Affinity
+	Identity   *Identity
+	ACL        ACL
+	TTL        int64
+	IPv6Prefix int
+	maxBody    int64
+	Routes     []*Routing
+	unmatched  *Routing
+	fallback   int
+	ids        []int
+	splitsMu   sync.RWMutex
+	splits     map[int][]Split
+	mirrors    map[int]*Mirror
+	redirects  map[int]*Redirect
+	failovers  map[int][]int
+	records    map[int]dnsRecords
+	// DNS only is set if some regions have records but no pool
+	dnsOnly    bool
+	identities IdentityTable
+	// Headers are rules of global and route scopes, region ones are kept separately
+	headers       []HeadersConfig
+	regionHeaders map[int]HeadersConfig
+	// Maintenance may be changed by admin API
+	maintenanceMu sync.RWMutex
+	maintenance   []*Maintenance
+}
+
+// NewRouting builds routing from flags and config sections.
+// Every upstream from --upstreams flag forms its own pool serving region with the same number.
+func NewRouting(env *Env) (*Routing, error) {
+	return newRouting(env, false)
+}
+
+// ValidateRouting checks pools, regions, routes and resolvers from flags and config sections.
+// Upstream transports are not created, discovery and health checks are not started.
+func ValidateRouting() error {
+	r, err := newRouting(&Env{}, true)
+	if err != nil {
+		return err
+	}
+	r.Close()
+	return nil
+}
+
+func newRouting(env *Env, validate bool) (*Routing, error) {
+	r := &Routing{
+		Pools:      make(map[string]*Pool),
+		Regions:    make(map[int]*Pool),
+		Transport:  make(UpstreamTransports),
+		dialer:     &net.Dialer{Timeout: UpstreamTransport.DialTimeout, KeepAlive: UpstreamTransport.KeepAlive},
+		TTL:        TTL,
+		IPv6Prefix: IPv6Prefix,
+		maxBody:    MaxBodySize,
+		fallback:   DefaultRegion,
+		splits:     make(map[int][]Split),
+		mirrors:    make(map[int]*Mirror),
+		redirects:  make(map[int]*Redirect),
+		failovers:  make(map[int][]int),
+		records:    make(map[int]dnsRecords),
+		headers:    []HeadersConfig{Headers},
+	}
+	if err := Headers.validate(); err != nil {
+		return nil, err
+	}
+
+	// Upstreams of static pools share transports by host, so their options must not conflict
+	options := make(map[string]TransportOptions)
+	for i, upstream := range Upstreams {
+		name := strconv.Itoa(i + 1)
+		pool, err := newPool(name, []string{upstream}, r.Transport, options, validate)
+		if err != nil {
+			return nil, err
+		}
+		r.Pools[name] = pool
+		r.Regions[i+1] = pool
+	}
+	for name, c := range Pools {
+		var pool *Pool
+		var err error
+		switch {
+		case validate && c.SRV != "":
+			pool, err = checkDiscoveredPool(name, c.SRV)
+		case validate && c.Consul != "":
+			pool, err = checkDiscoveredPool(name, c.Consul)
+		case validate && c.Etcd != "":
+			// Upstreams are stored in etcd, so there is nothing to check
+			pool = NewPool(name, nil)
+		case c.SRV != "":
+			pool, err = NewSRVPool(name, c.SRV)
+		case c.Consul != "":
+			pool, err = NewConsulPool(name, c.Consul)
+		case c.Etcd != "":
+			pool, err = NewEtcdPool(name, c.Etcd)
+		default:
+			pool, err = newPool(name, c.Upstreams, r.Transport, options, validate)
+		}
+		if err != nil {
+			return r.fail(err)
+		}
+		r.Pools[name] = pool
+	}
+
+	// Regions of the default route are optional if there are other routes
+	if len(r.Regions) > 0 || len(RegionConfigs) > 0 || len(RouteConfigs) == 0 {
+		if err := r.setRegions(RegionConfigs, RegionCIDRs, ResolverConfigs, env); err != nil {
+			return r.fail(err)
+		}
+		r.unmatched = r
+	}
+	var err error
+	if r.Override, err = NewOverride(); err != nil {
+		return r.fail(err)
+	}
+	if r.Affinity, err = NewAffinity(); err != nil {
+		return r.fail(err)
+	}
+	if r.Identity, err = NewIdentity(); err != nil {
+		return r.fail(err)
+	}
+	if r.ACL, err = NewACL(AccessConfigs); err != nil {
+		return r.fail(err)
+	}
+
+	names := make(map[string]*Routing)
+	for _, c := range RouteConfigs {
+		route, err := r.newRoute(c, env)
+		if err != nil {
+			return r.fail(err)
+		}
+		if _, ok := names[c.Name]; ok {
+			return r.fail(fmt.Errorf("route %s: duplicate name", c.Name))
+		}
+		names[c.Name] = route
+		r.Routes = append(r.Routes, route)
+	}
+	// Client limit is shared by all routes
+	var limiter *Limiter
+	for _, route := range append([]*Routing{r}, r.Routes...) {
+		if route.Limiter == nil {
+			continue
+		}
+		if limiter == nil {
+			limiter = route.Limiter
+		}
+		route.Limiter.shareClients(limiter)
+	}
+	for _, c := range MaintenanceConfigs {
+		route, err := r.route(c.Route)
+		if err == nil {
+			err = route.SetMaintenance(c)
+		}
+		if err != nil {
+			return r.fail(err)
+		}
+	}
+	if DefaultRoute != "" {
+		route, ok := names[DefaultRoute]
+		if !ok {
+			return r.fail(fmt.Errorf("default route '%s' is not found", DefaultRoute))
+		}
+		r.unmatched = route
+	}
+	switch Balance {
+	case "", "random":
+	case "least-conn":
+		for _, pool := range r.Pools {
+			pool.LeastConn = true
+		}
+	default:
+		return r.fail(fmt.Errorf("unknown balance method '%s'", Balance))
+	}
+	if HealthPath != "" || HealthTCP {
+		if HealthInterval <= 0 || HealthTimeout <= 0 {
+			return r.fail(fmt.Errorf("health interval and timeout must be positive"))
+		}
+		for _, pool := range r.Pools {
+			if validate {
+				break
+			}
+			r.watchHealth(pool)
+		}
+	}
+	return r, nil
+}
+
+// Builds region table, resolvers and limiter of routing. Command line mappings and limits
+// are appended to the ones from config, so they take precedence.
+func (r *Routing) setRegions(regions []RegionConfig, regionCIDRs []string, resolvers []ResolverConfig, env *Env) error {
+	var cidrs, limits []string
+	identities := make(IdentityTable)
+	for _, c := range regions {
+		if c.ID <= 0 {
+			return fmt.Errorf("region %d: id must be positive", c.ID)
+		}
+		if c.Pool != "" {
+			pool, ok := r.Pools[c.Pool]
+			if !ok {
+				return fmt.Errorf("region %d: unknown pool '%s'", c.ID, c.Pool)
+			}
+			r.Regions[c.ID] = pool
+		}
+		// Region without pool is answered by GeoDNS only
+		if _, ok := r.Regions[c.ID]; !ok {
+			if len(c.Records) == 0 {
+				return fmt.Errorf("region %d: pool is not specified", c.ID)
+			}
+			r.dnsOnly = true
+		}
+		for _, cidr := range c.CIDRs {
+			cidrs = append(cidrs, cidr+"="+strconv.Itoa(c.ID))
+		}
+		if c.Limit != "" {
+			limits = append(limits, strconv.Itoa(c.ID)+"="+c.Limit)
+		}
+		for _, client := range c.Identities {
+			if region, ok := identities[client]; ok && region != c.ID {
+				return fmt.Errorf("region %d: identity '%s' belongs to region %d", c.ID, client, region)
+			}
+			identities[client] = c.ID
+		}
+	}
+	if len(r.Regions) == 0 && !r.dnsOnly {
+		return fmt.Errorf("no upstreams are configured")
+	}
+	for _, c := range regions {
+		if len(c.Splits) == 0 {
+			continue
+		}
+		splits, err := r.newSplits(c.ID, c.Splits)
+		if err != nil {
+			return err
+		}
+		r.splits[c.ID] = splits
+	}
+	for _, c := range regions {
+		if c.Mirror == nil {
+			continue
+		}
+		mirror, err := r.newMirror(c.ID, *c.Mirror)
+		if err != nil {
+			return err
+		}
+		r.mirrors[c.ID] = mirror
+	}
+	for _, c := range regions {
+		if c.Redirect == nil {
+			continue
+		}
+		redirect, err := r.newRedirect(c.ID, *c.Redirect)
+		if err != nil {
+			return err
+		}
+		r.redirects[c.ID] = redirect
+	}
+	for _, c := range regions {
+		for _, region := range c.Failover {
+			if _, ok := r.Regions[region]; !ok || region == c.ID {
+				return fmt.Errorf("region %d: invalid failover region %d", c.ID, region)
+			}
+		}
+		if len(c.Failover) > 0 {
+			r.failovers[c.ID] = c.Failover
+		}
+	}
+	for _, c := range regions {
+		if c.Headers == nil {
+			continue
+		}
+		if err := c.Headers.validate(); err != nil {
+			return fmt.Errorf("region %d: %v", c.ID, err)
+		}
+		if r.regionHeaders == nil {
+			r.regionHeaders = make(map[int]HeadersConfig)
+		}
+		r.regionHeaders[c.ID] = *c.Headers
+	}
+	for _, c := range regions {
+		if len(c.Records) == 0 {
+			continue
+		}
+		records, err := parseRecords(c.Records)
+		if err != nil {
+			return fmt.Errorf("region %d: %v", c.ID, err)
+		}
+		r.records[c.ID] = records
+	}
+	for id := range r.Regions {
+		r.ids = append(r.ids, id)
+	}
+	sort.Ints(r.ids)
+
+	table, err := ParseRegionTable(append(cidrs, regionCIDRs...))
+	if err != nil {
+		return err
+	}
+	if r.Resolver, err = newResolvers(resolvers, table, identities, env); err != nil {
+		return err
+	}
+	r.identities = identities
+	if r.Limiter, err = NewLimiter(append(limits, RegionLimits...), ClientLimit); err != nil {
+		return err
+	}
+
+	if r.fallback == 0 && env.Ora != nil && len(r.ids) > 0 {
+		r.fallback = r.ids[0]
+	}
+	_, pooled := r.Regions[r.fallback]
+	_, answered := r.records[r.fallback]
+	if r.fallback != 0 && !pooled && !answered {
+		return fmt.Errorf("default region %d has no pool", r.fallback)
+	}
+	return nil
+}
+
+// Stops discovered pools of routing which failed to build
+func (r *Routing) fail(err error) (*Routing, error) {
+	r.Close()
+	return nil, err
+}
+
+// Close stops background update of discovered pools and closes idle upstream connections
+func (r *Routing) Close() {
+	for _, pool := range r.Pools {
+		pool.Close()
+		if c, ok := pool.Transport.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+	r.Transport.CloseIdleConnections()
+}
+
+// Region resolves region of client by its identity if it is not empty and then by its IP.
+// Default region is returned if region is not resolved.
+func (r *Routing) Region(identity string, ip string) int {
+	for _, client := range []string{identity, ip} {
+		if client == "" {
+			continue
+		}
+		if region, err := r.Resolver.Resolve(client); err == nil {
+			if _, ok := r.Regions[region]; ok {
+				return region
+			}
+			log.Printf("[%s] - Error: no pool for region %d\n", client, region)
+		}
+	}
+	if r.fallback != 0 || len(r.ids) == 0 {
+		return r.fallback
+	}
+	return r.ids[rand.Intn(len(r.ids))]
+}
+
+// Target selects upstream for client of region and returns it with its pool name.
+// Returns nil if region has no upstreams.
+func (r *Routing) Target(region int, key string) (*url.URL, string) {
+	pool := r.Pool(region, key)
+	if pool == nil {
+		return nil, ""
+	}
+	return pool.Pick(), pool.Name
+}
+
+// Contains checks if upstream belongs to the pool of client region
+func (r *Routing) Contains(region int, key string, target *url.URL) bool {
+	pool := r.Pool(region, key)
+	if pool == nil {
+		return false
+	}
+	for _, t := range pool.Targets() {
+		if t.String() == target.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns transport of pool, routing transports are used for static pools
+func (r *Routing) poolTransport(pool *Pool) http.RoundTripper {
+	if pool != nil && pool.Transport != nil {
+		return pool.Transport
+	}
+	return r.Transport
+}
+
+// Parses pool upstreams and registers their transports and transport options
+func newPool(name string, upstreams []string, transports UpstreamTransports, options map[string]TransportOptions, validate bool) (*Pool, error) {
+	urls, trs, err := toUrls(upstreams, options, validate)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %v", name, err)
+	}
+	for k, tr := range trs {
+		transports[k] = tr
+	}
+	return NewPool(name, urls), nil
+}
+
+// Checks upstream template of discovered pool, returns empty pool as discovery is not started
+func checkDiscoveredPool(name string, upstream string) (*Pool, error) {
+	_, opts, err := ParseUpstream(upstream, UpstreamTransport)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %v", name, err)
+	}
+	if _, err := upstreamTLS(opts); err != nil {
+		return nil, fmt.Errorf("pool %s: upstream %s: %v", name, upstream, err)
+	}
+	return NewPool(name, nil), nil
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ReadHeaderTimeout is time client is given to send request headers, it protects from slowloris clients
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is time client is given to send the whole request including body, zero means no timeout
+	ReadTimeout time.Duration
+	// WriteTimeout is time response is given to be written, zero means no timeout
+	WriteTimeout time.Duration
+	// ClientIdleTimeout is time idle keep-alive client connection is kept open
+	ClientIdleTimeout time.Duration
+	// MaxHeaderBytes is maximum size of request headers
+	MaxHeaderBytes int
+	// MaxConns is maximum number of concurrent client connections, zero means no limit
+	MaxConns int
+	// MaxBodySize is maximum size of request body in bytes, routes may override it, zero means no limit
+	MaxBodySize int64
+	serverStats = expvar.NewMap("server")
+)
+
+// NewServer creates HTTP server with timeouts and header size limit from flags
+func NewServer(handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		ReadTimeout:       ReadTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       ClientIdleTimeout,
+		MaxHeaderBytes:    MaxHeaderBytes,
+	}
+}
+
+// LimitListener accepts at most n concurrent connections, listener waits for a connection to be closed
+// before accepting the next one. Listener is returned as is if n is not positive.
+func LimitListener(ln net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return ln
+	}
+	return &limitListener{Listener: ln, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+type limitListener struct {
+	net.Listener
+	sem  chan struct{}
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	default:
+		serverStats.Add("conns-limited", 1)
+		select {
+		case l.sem <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	serverStats.Add("conns", 1)
+	return &limitConn{Conn: c, release: func() {
+		serverStats.Add("conns", -1)
+		<-l.sem
+	}}, nil
+}
+
+// Close stops listener, including Accept waiting for a free slot
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// Limits request body by max body size of routing. Returns false and responds with 413 if request
+// declares larger body, body exceeding the limit while it is forwarded fails with 413 too.
+func (r *Routing) limitBody(w http.ResponseWriter, req *http.Request) bool {
+	if r.maxBody <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.ContentLength > r.maxBody {
+		serverStats.Add("body-too-large", 1)
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, r.maxBody)
+	return true
+}
+
+// Responds to failed proxy request with 413 if request body exceeds the limit and with 502 otherwise
+func proxyError(w http.ResponseWriter, req *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		serverStats.Add("body-too-large", 1)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Printf("[%s] - Error: %v\n", ClientIP(req), err)
+	w.WriteHeader(http.StatusBadGateway)
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// SRVInterval is a period DNS SRV records of discovered pools are re-resolved with
+	SRVInterval time.Duration
+	// DNSServer is address of DNS server SRV records are resolved with, system resolver is used if empty
+	DNSServer string
+)
+
+// NewSRVPool creates pool which targets are discovered by DNS SRV records and re-resolved every SRVInterval.
+// Upstream is in form of '[scheme://]_service._proto.name[/base][?option=value]', its scheme, base path
+// and options are applied to every discovered target. Pool is empty until records are resolved.
+func NewSRVPool(name string, upstream string) (*Pool, error) {
+	template, opts, err := ParseUpstream(upstream, UpstreamTransport)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %v", name, err)
+	}
+	tr, err := NewTransport(opts)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: upstream %s: %v", name, upstream, err)
+	}
+	pool := newDiscoveredPool(name, tr)
+
+	w := &srvWatcher{pool: pool, name: template.Hostname(), template: template, resolver: newDNSResolver(DNSServer)}
+	w.update()
+	if SRVInterval > 0 {
+		go w.run(SRVInterval)
+	}
+	return pool, nil
+}
+
+type srvWatcher struct {
+	pool     *Pool
+	name     string
+	template *url.URL
+	resolver *net.Resolver
+	current  string
+}
+
+func (w *srvWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.pool.stop:
+			return
+		case <-ticker.C:
+			w.update()
+		}
+	}
+}
+
+// Resolves SRV records and replaces pool targets if they are changed.
+// Current targets are kept if records can't be resolved.
+func (w *srvWatcher) update() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, records, err := w.resolver.LookupSRV(ctx, "", "", w.name)
+	if err != nil {
+		log.Printf("Pool %s: SRV %s is not resolved: %v\n", w.pool.Name, w.name, err)
+		return
+	}
+	targets, weights, priorities := srvTargets(w.template, records)
+
+	var members []string
+	for i, t := range targets {
+		members = append(members, t.Host+"/"+strconv.Itoa(priorities[i])+"/"+strconv.Itoa(weights[i]))
+	}
+	if current := strings.Join(members, ","); current != w.current {
+		w.current = current
+		w.pool.setTargets(targets, weights, priorities)
+		log.Printf("Pool %s: SRV %s is resolved to [%s]\n", w.pool.Name, w.name, current)
+	}
+}
+
+// Converts SRV records to targets with weights and priorities. Records of the lowest priority
+// get traffic, the rest ones are backups used when all records of lower priority are unavailable.
+func srvTargets(template *url.URL, records []*net.SRV) ([]*url.URL, []int, []int) {
+	targets := []*url.URL{}
+	weights := []int{}
+	priorities := []int{}
+	for _, r := range records {
+		t := *template
+		t.Host = net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		targets = append(targets, &t)
+		weights = append(weights, int(r.Weight))
+		priorities = append(priorities, int(r.Priority))
+	}
+	return targets, weights, priorities
+}
+
+// Creates resolver which queries DNS server by address or system resolver if address is empty
+func newDNSResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	tcpStats    = expvar.NewMap("tcp")
+	tcpproxyCmd = &cobra.Command{
+		Use:   "tcpproxy",
+		Short: "Run TCP proxy server",
+		Run: func(cmd *cobra.Command, args []string) {
+			if metricsPort > 0 {
+				go http.ListenAndServe(":"+strconv.Itoa(metricsPort), nil)
+				log.Printf("Metrics HTTP server is listening on port %d\n", metricsPort)
+			}
+			env := openEnv()
+			defer env.Close()
+			p := NewTCPProxy(env)
+			if err := p.WatchReload(cmd.Flags()); err != nil {
+				log.Fatal(err)
+			}
+			ln, err := newListener(port)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go func() {
+				if err := p.Serve(ln); err != nil {
+					log.Fatal(err)
+				}
+			}()
+
+			ctx, cancel := waitShutdown()
+			defer cancel()
+			p.Shutdown()
+			p.Drain(ctx)
+			p.Close()
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(tcpproxyCmd)
+	addProxyFlags(tcpproxyCmd.PersistentFlags())
+}
+
+// TCPProxy splices TCP connections to upstreams selected by client region. Region resolution, caching,
+// access rules, maintenance, failover and limits are shared with HTTP proxy. Virtual routes don't apply,
+// connections are routed by default regions or by default route.
+type TCPProxy struct {
+	*Proxy
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+}
+
+// NewTCPProxy creates TCP proxy that will select a host from the pool of client region
+func NewTCPProxy(env *Env) *TCPProxy {
+	p := &TCPProxy{Proxy: newProxy(env)}
+	routing := p.routing.Load()
+	log.Printf("TCP proxy is listening on port %d for %d regions with TTL %d seconds", port, len(routing.Regions), routing.TTL)
+	return p
+}
+
+// Serve accepts connections on listener until it is closed by Shutdown
+func (p *TCPProxy) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.closed {
+				return nil
+			}
+			return err
+		}
+		go p.handle(c)
+	}
+}
+
+// Shutdown stops accepting connections, connections in progress are finished by Drain
+func (p *TCPProxy) Shutdown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.ln != nil {
+		p.ln.Close()
+	}
+}
+
+func (p *TCPProxy) handle(c net.Conn) {
+	defer c.Close()
+	routing := p.routing.Load().unmatched
+	if routing == nil {
+		tcpStats.Add("rejected", 1)
+		return
+	}
+	ip := CanonicalIP(hostOnly(c.RemoteAddr().String()))
+	key := routing.cacheKey(ClientKey(ip, routing.IPv6Prefix))
+	u := p.upstream(routing, "", ip, key)
+	if u == nil {
+		tcpStats.Add("errors", 1)
+		return
+	}
+	// Access rules are checked without path, so only rules without paths apply
+	if routing.ACL.Check(u.Region, ip, "") != nil {
+		tcpStats.Add("rejected", 1)
+		return
+	}
+	if f := routing.failover(u, key); f != nil {
+		u = f
+	}
+	if m := routing.underMaintenance(u); m != nil {
+		fallback := m.fallback(routing, key)
+		if fallback == nil {
+			maintenanceStats.Add("region."+strconv.Itoa(u.Region)+".served", 1)
+			tcpStats.Add("rejected", 1)
+			return
+		}
+		maintenanceStats.Add("region."+strconv.Itoa(u.Region)+".fallback", 1)
+		u = fallback
+	}
+	release, _ := routing.Limiter.Acquire(u.Region, ClientKey(ip, routing.IPv6Prefix))
+	if release == nil {
+		tcpStats.Add("rejected", 1)
+		return
+	}
+	defer release()
+	defer upstreamConns.acquire(u.Target.Host)()
+
+	backend, err := routing.dialer.Dial("tcp", u.Target.Host)
+	if err != nil {
+		tcpStats.Add("errors", 1)
+		log.Printf("[%s] - Error: %v\n", ip, err)
+		return
+	}
+	tcpStats.Add("connections", 1)
+	tcpStats.Add("region."+strconv.Itoa(u.Region)+".connections", 1)
+	in, out := splice(c, p.trackUpgrade(u.Target, backend))
+	tcpStats.Add("bytes-in", in)
+	tcpStats.Add("bytes-out", out)
+}
+
+// Copies data between client and upstream in both directions. End of client data is passed to upstream
+// by half-close, connection is over when upstream closes it. Returns bytes sent by client and upstream.
+func splice(client net.Conn, upstream io.ReadWriteCloser) (int64, int64) {
+	sent := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(upstream, client)
+		if cw, ok := upstream.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		sent <- n
+	}()
+	out, _ := io.Copy(client, upstream)
+	client.Close()
+	upstream.Close()
+	return <-sent, out
+}
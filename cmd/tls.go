@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	// TLSCert is default server certificate filename
+	TLSCert string
+	// TLSKey is default server private key filename
+	TLSKey string
+	// TLSCertDir is a directory with additional SNI certificates in form of 'name.crt' and 'name.key' pairs
+	TLSCertDir string
+	// TLSClientCA is CA bundle filename used to verify client certificates
+	TLSClientCA string
+	// TLSClientAuth is client certificate policy: 'none', 'request', 'require', 'verify-if-given' or 'verify'.
+	// Empty policy means 'verify' if client CA is given and 'none' otherwise.
+	TLSClientAuth string
+)
+
+// Delay before reloading certificates or config to let all related file events settle down
+const reloadDelay = 500 * time.Millisecond
+
+// CertStore holds server certificates and selects them by SNI server name
+type CertStore struct {
+	certFile string
+	keyFile  string
+	dir      string
+
+	mu     sync.RWMutex
+	def    *tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+// NewCertStore creates certificate store and loads certificates into it.
+// Either certFile/keyFile pair or dir (or both) must be specified.
+func NewCertStore(certFile, keyFile, dir string) (*CertStore, error) {
+	if certFile == "" && dir == "" {
+		return nil, fmt.Errorf("neither certificate nor certificate directory is specified")
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both certificate and private key must be specified")
+	}
+	s := &CertStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+		dir:      dir,
+	}
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load (re)reads all certificates from disk. Old certificates are kept on error.
+func (s *CertStore) Load() error {
+	var def *tls.Certificate
+	byName := make(map[string]*tls.Certificate)
+
+	if s.certFile != "" {
+		cert, err := loadCertificate(s.certFile, s.keyFile)
+		if err != nil {
+			return err
+		}
+		def = cert
+		addCertificateNames(byName, cert)
+	}
+
+	if s.dir != "" {
+		files, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+		if err != nil {
+			return err
+		}
+		for _, certFile := range files {
+			keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+			cert, err := loadCertificate(certFile, keyFile)
+			if err != nil {
+				return err
+			}
+			if def == nil {
+				def = cert
+			}
+			addCertificateNames(byName, cert)
+		}
+	}
+
+	if def == nil {
+		return fmt.Errorf("no certificates found in %s", s.dir)
+	}
+
+	s.mu.Lock()
+	s.def = def
+	s.byName = byName
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns certificate matching SNI server name exactly or by wildcard.
+// Default certificate is returned if nothing is matched.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.def, nil
+}
+
+// Watch reloads certificates when their files are changed
+func (s *CertStore) Watch() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// Watch directories instead of files because certificates are usually replaced by renaming
+	dirs := make(map[string]bool)
+	if s.certFile != "" {
+		dirs[filepath.Dir(s.certFile)] = true
+		dirs[filepath.Dir(s.keyFile)] = true
+	}
+	if s.dir != "" {
+		dirs[s.dir] = true
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	go func() {
+		var reload <-chan time.Time
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if s.isRelated(ev.Name) {
+					reload = time.After(reloadDelay)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Certificate watcher error: %v\n", err)
+			case <-reload:
+				reload = nil
+				if err := s.Load(); err != nil {
+					log.Printf("Certificates are not reloaded: %v\n", err)
+				} else {
+					log.Printf("Certificates are reloaded\n")
+				}
+			}
+		}
+	}()
+	return w, nil
+}
+
+// Checks if file belongs to the store
+func (s *CertStore) isRelated(name string) bool {
+	name = filepath.Clean(name)
+	if s.certFile != "" && (name == filepath.Clean(s.certFile) || name == filepath.Clean(s.keyFile)) {
+		return true
+	}
+	if s.dir != "" && filepath.Dir(name) == filepath.Clean(s.dir) {
+		ext := filepath.Ext(name)
+		return ext == ".crt" || ext == ".key"
+	}
+	return false
+}
+
+// NewTLSConfig creates server TLS configuration with HTTP/2 support.
+// Client certificates are verified against clientCA bundle according to clientAuth policy.
+// Empty policy means 'verify' if client CA bundle is given and 'none' otherwise.
+func NewTLSConfig(store *CertStore, clientCA string, clientAuth string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	auth, err := parseClientAuth(clientAuth)
+	if err != nil {
+		return nil, err
+	}
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		switch clientAuth {
+		case "":
+			auth = tls.RequireAndVerifyClientCert
+		case "none":
+			return nil, fmt.Errorf("client CA bundle can't be used with 'none' client auth")
+		}
+	} else if auth >= tls.VerifyClientCertIfGiven {
+		return nil, fmt.Errorf("client CA bundle is required for '%s' client auth", clientAuth)
+	}
+	cfg.ClientAuth = auth
+	return cfg, nil
+}
+
+// Creates server TLS configuration from command line flags. Returns nil if TLS is not enabled.
+func newServerTLSConfig() (*tls.Config, error) {
+	if TLSCert == "" && TLSCertDir == "" {
+		return nil, nil
+	}
+	store, err := NewCertStore(TLSCert, TLSKey, TLSCertDir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.Watch(); err != nil {
+		return nil, err
+	}
+	return NewTLSConfig(store, TLSClientCA, TLSClientAuth)
+}
+
+func parseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "verify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth policy '%s'", s)
+}
+
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate %s: %v", certFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate %s: %v", certFile, err)
+	}
+	return &cert, nil
+}
+
+func loadCertPool(fn string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", fn)
+	}
+	return pool, nil
+}
+
+// Registers certificate under its subject common name and DNS names
+func addCertificateNames(m map[string]*tls.Certificate, cert *tls.Certificate) {
+	names := cert.Leaf.DNSNames
+	if cn := cert.Leaf.Subject.CommonName; cn != "" {
+		names = append([]string{cn}, names...)
+	}
+	for _, name := range names {
+		m[strings.ToLower(name)] = cert
+	}
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"log"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// UpgradeIdleTimeout closes upgraded connection, e.g. WebSocket, or TCP proxy connection without traffic
+	// in both directions. Zero means no timeout.
+	UpgradeIdleTimeout time.Duration
+	// DrainTimeout is time upgraded connections are given to finish on shutdown or after removal of their upstream
+	DrainTimeout time.Duration
+	// Balance is a method upstream is picked from pool with: 'random' or 'least-conn'
+	Balance       string
+	upstreamStats = expvar.NewMap("upstreams")
+	upstreamConns = &connTracker{active: make(map[string]int), upgraded: make(map[*upgradedConn]bool)}
+)
+
+// Tracks requests in flight and upgraded connections per upstream host
+type connTracker struct {
+	mu       sync.Mutex
+	active   map[string]int
+	upgraded map[*upgradedConn]bool
+}
+
+// Counts request or connection to upstream host until it is released
+func (t *connTracker) acquire(host string) (release func()) {
+	t.mu.Lock()
+	t.active[host]++
+	t.mu.Unlock()
+	upstreamStats.Add(host+".active", 1)
+	return func() {
+		t.mu.Lock()
+		if t.active[host]--; t.active[host] <= 0 {
+			delete(t.active, host)
+		}
+		t.mu.Unlock()
+		upstreamStats.Add(host+".active", -1)
+	}
+}
+
+// Returns number of requests in flight and upgraded connections of upstream host
+func (t *connTracker) Active(host string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active[host]
+}
+
+// Returns current upgraded connections
+func (t *connTracker) connections() []*upgradedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var conns []*upgradedConn
+	for c := range t.upgraded {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Upgraded connection or TCP proxy connection to upstream which records time of last traffic
+type upgradedConn struct {
+	io.ReadWriteCloser
+	target url.URL
+	last   atomic.Int64
+	once   sync.Once
+	done   chan struct{}
+}
+
+func (c *upgradedConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	c.last.Store(time.Now().UnixNano())
+	return n, err
+}
+
+func (c *upgradedConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	c.last.Store(time.Now().UnixNano())
+	return n, err
+}
+
+// CloseWrite half-closes upstream side of connection if it supports it
+func (c *upgradedConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close closes upstream side of connection, so reverse proxy closes client side too
+func (c *upgradedConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		upstreamConns.mu.Lock()
+		delete(upstreamConns.upgraded, c)
+		upstreamConns.mu.Unlock()
+		upstreamStats.Add(c.target.Host+".upgraded", -1)
+		err = c.ReadWriteCloser.Close()
+		close(c.done)
+	})
+	return err
+}
+
+// Tracks upgraded connection to upstream and closes it when it is idle or its upstream is removed.
+// Upgraded connection is counted as request in flight until reverse proxy finishes it.
+func (p *Proxy) trackUpgrade(target url.URL, body io.ReadWriteCloser) io.ReadWriteCloser {
+	c := &upgradedConn{ReadWriteCloser: body, target: target, done: make(chan struct{})}
+	c.last.Store(time.Now().UnixNano())
+	upstreamConns.mu.Lock()
+	upstreamConns.upgraded[c] = true
+	upstreamConns.mu.Unlock()
+	upstreamStats.Add(target.Host+".upgraded", 1)
+	upstreamStats.Add("upgrades", 1)
+	go p.watchUpgrade(c, UpgradeIdleTimeout, DrainTimeout)
+	return c
+}
+
+func (p *Proxy) watchUpgrade(c *upgradedConn, idle time.Duration, drain time.Duration) {
+	interval := time.Second
+	for _, d := range []time.Duration{idle, drain} {
+		if d > 0 && d/2 < interval {
+			interval = d / 2
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var removed time.Time
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if idle > 0 && now.Sub(time.Unix(0, c.last.Load())) >= idle {
+				upstreamStats.Add("idle-closed", 1)
+				log.Printf("Connection to %s is closed after %v of inactivity\n", c.target.Host, idle)
+				c.Close()
+				return
+			}
+			if p.routing.Load().servesTarget(&c.target) {
+				removed = time.Time{}
+				continue
+			}
+			if removed.IsZero() {
+				removed = now
+			}
+			if now.Sub(removed) >= drain {
+				upstreamStats.Add("drained", 1)
+				log.Printf("Connection to %s is closed since upstream is removed\n", c.target.Host)
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Drain waits for upgraded connections to finish until context is done, then closes the rest of them
+func (p *Proxy) Drain(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for len(upstreamConns.connections()) > 0 {
+		select {
+		case <-ctx.Done():
+			for _, c := range upstreamConns.connections() {
+				upstreamStats.Add("drained", 1)
+				c.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks if upstream belongs to any pool of routing
+func (r *Routing) servesTarget(target *url.URL) bool {
+	for _, pool := range r.Pools {
+		for _, t := range pool.Targets() {
+			if t.String() == target.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TransportOptions holds connection settings of upstream
+type TransportOptions struct {
+	// CA is CA bundle filename used to verify upstream certificate
+	CA string
+	// Cert and Key are client certificate and private key filenames
+	Cert string
+	Key  string
+	// ServerName overrides SNI and certificate verification name
+	ServerName string
+	// Insecure disables upstream certificate verification
+	Insecure bool
+	// H2C enables HTTP/2 over cleartext (prior knowledge)
+	H2C             bool
+	DialTimeout     time.Duration
+	ResponseTimeout time.Duration
+	IdleTimeout     time.Duration
+	KeepAlive       time.Duration
+	MaxIdleConns    int
+}
+
+// UpstreamTransport holds default connection settings for all upstreams
+var UpstreamTransport = TransportOptions{
+	DialTimeout: 30 * time.Second,
+	IdleTimeout: 90 * time.Second,
+	KeepAlive:   30 * time.Second,
+}
+
+// ParseUpstream parses upstream in form of 'host:port' or 'scheme://host:port/base?option=value'.
+// Supported schemes are 'http', 'https' and 'h2c'. Known options override defaults
+// and are removed from resulting URL, other query parameters are passed to upstream.
+func ParseUpstream(s string, defaults TransportOptions) (*url.URL, TransportOptions, error) {
+	opts := defaults
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, opts, fmt.Errorf("upstream %s: %v", s, err)
+	}
+	if u.Host == "" {
+		return nil, opts, fmt.Errorf("upstream %s: host is empty", s)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "h2c":
+		u.Scheme = "http"
+		opts.H2C = true
+	default:
+		return nil, opts, fmt.Errorf("upstream %s: unsupported scheme '%s'", s, u.Scheme)
+	}
+
+	q := u.Query()
+	for name, values := range q {
+		v := values[0]
+		switch name {
+		case "ca":
+			opts.CA = v
+		case "cert":
+			opts.Cert = v
+		case "key":
+			opts.Key = v
+		case "server-name":
+			opts.ServerName = v
+		case "insecure":
+			opts.Insecure, err = strconv.ParseBool(v)
+		case "dial-timeout":
+			opts.DialTimeout, err = time.ParseDuration(v)
+		case "response-timeout":
+			opts.ResponseTimeout, err = time.ParseDuration(v)
+		case "idle-timeout":
+			opts.IdleTimeout, err = time.ParseDuration(v)
+		case "keep-alive":
+			opts.KeepAlive, err = time.ParseDuration(v)
+		case "max-idle-conns":
+			opts.MaxIdleConns, err = strconv.Atoi(v)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, opts, fmt.Errorf("upstream %s: option %s: %v", s, name, err)
+		}
+		q.Del(name)
+	}
+	u.RawQuery = q.Encode()
+	return u, opts, nil
+}
+
+// NewTransport creates HTTP transport according to connection settings
+func NewTransport(opts TransportOptions) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: opts.ResponseTimeout,
+		IdleConnTimeout:       opts.IdleTimeout,
+		MaxIdleConnsPerHost:   opts.MaxIdleConns,
+		ForceAttemptHTTP2:     true,
+	}
+
+	cfg, err := upstreamTLS(opts)
+	if err != nil {
+		return nil, err
+	}
+	tr.TLSClientConfig = cfg
+
+	if opts.H2C {
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return tr, nil
+}
+
+// Creates TLS config of upstream transport, CA bundle and client certificate are loaded from files
+func upstreamTLS(opts TransportOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.Insecure,
+	}
+	if opts.CA != "" {
+		pool, err := loadCertPool(opts.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if opts.Cert != "" {
+		cert, err := loadCertificate(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg, nil
+}
+
+// UpstreamTransports selects transport by upstream scheme and host
+type UpstreamTransports map[string]http.RoundTripper
+
+// RoundTrip implements http.RoundTripper
+func (t UpstreamTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tr, ok := t[transportKey(req.URL)]; ok {
+		return tr.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Converts list of upstreams to the list of URLs and transports for them. Upstreams with the same
+// scheme and host share transport, so their options must be the same. Options of already registered
+// hosts are kept in options. If upstreams are only validated, transports are not created and just
+// their TLS files are loaded.
+func toUrls(upstreams []string, options map[string]TransportOptions, validate bool) ([]*url.URL, UpstreamTransports, error) {
+	var urls []*url.URL
+	transports := make(UpstreamTransports)
+	for _, upstream := range upstreams {
+		u, opts, err := ParseUpstream(upstream, UpstreamTransport)
+		if err != nil {
+			return nil, nil, err
+		}
+		key := transportKey(u)
+		if err := checkTransport(options, key, opts); err != nil {
+			return nil, nil, fmt.Errorf("upstream %s: %v", upstream, err)
+		}
+		urls = append(urls, u)
+		if _, ok := transports[key]; ok {
+			continue
+		}
+		if validate {
+			if _, err := upstreamTLS(opts); err != nil {
+				return nil, nil, fmt.Errorf("upstream %s: %v", upstream, err)
+			}
+			continue
+		}
+		tr, err := NewTransport(opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("upstream %s: %v", upstream, err)
+		}
+		transports[key] = tr
+	}
+	return urls, transports, nil
+}
+
+// Registers options of transport key, options must be the same as already registered ones
+func checkTransport(options map[string]TransportOptions, key string, opts TransportOptions) error {
+	if registered, ok := options[key]; ok && registered != opts {
+		return fmt.Errorf("transport options conflict with another upstream of %s", key)
+	}
+	options[key] = opts
+	return nil
+}
+
+func transportKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// CloseIdleConnections closes idle connections of all transports
+func (t UpstreamTransports) CloseIdleConnections() {
+	for _, tr := range t {
+		if c, ok := tr.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
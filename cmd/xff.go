@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	// TrustedProxies holds CIDRs of proxies which are allowed to set forwarding headers and PROXY protocol header
+	TrustedProxies = []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7"}
+	// TrustedHops is a number of proxies in front of regiond. When it is positive, client address is taken
+	// from this position counting from the right of forwarding chain instead of skipping trusted proxies.
+	TrustedHops int
+	// ProxyProtocol enables PROXY protocol v1/v2 on listener
+	ProxyProtocol bool
+)
+
+// Networks is a list of CIDRs
+type Networks []*net.IPNet
+
+// ParseNetworks parses list of CIDRs, single addresses are treated as host networks
+func ParseNetworks(cidrs []string) (Networks, error) {
+	var nets Networks
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Contains checks if any of networks contains IP
+func (nets Networks) Contains(ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewXffProxy wraps reverse proxy with handler which determines client IP from
+// Forwarded or X-Forwarded-For headers set by trusted proxies
+func NewXffProxy(h http.Handler) http.Handler {
+	trusted, err := ParseNetworks(TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := clientIP(req, trusted, TrustedHops)
+		ctx := context.WithValue(req.Context(), clientIPKey, ip)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// ClientIP returns client IP determined by NewXffProxy or remote address of request
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return hostOnly(req.RemoteAddr)
+}
+
+// Walks forwarding chain from the right. Returns the first address which is not trusted or
+// address at the hops position if it is set. Chain is not used if peer is not a trusted proxy.
+func clientIP(req *http.Request, trusted Networks, hops int) string {
+	peer := hostOnly(req.RemoteAddr)
+	if ip := net.ParseIP(peer); ip == nil || !trusted.Contains(ip) {
+		return peer
+	}
+
+	var chain []string
+	if values := req.Header["Forwarded"]; len(values) > 0 {
+		chain = parseForwarded(values)
+	} else {
+		for _, v := range req.Header["X-Forwarded-For"] {
+			for _, s := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(s))
+			}
+		}
+	}
+	chain = append(chain, peer)
+
+	if hops > 0 {
+		i := len(chain) - 1 - hops
+		if i < 0 {
+			i = 0
+		}
+		if ip := net.ParseIP(hostOnly(chain[i])); ip != nil {
+			return ip.String()
+		}
+		return peer
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hostOnly(chain[i]))
+		if ip == nil {
+			// Obfuscated or malformed address, nothing to the left of it may be trusted
+			break
+		}
+		client = ip.String()
+		if !trusted.Contains(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// Extracts 'for' parameters from RFC 7239 Forwarded header values
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			node := ""
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					node = strings.Trim(kv[1], "\"")
+				}
+			}
+			chain = append(chain, node)
+		}
+	}
+	return chain
+}
+
+// Strips port and IPv6 brackets from address
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fake Consul health API with blocking queries
+type fakeConsul struct {
+	mu        sync.Mutex
+	index     int
+	instances map[string][]string // tag -> host:port
+	changed   chan struct{}
+}
+
+func (c *fakeConsul) set(tag string, instances ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances[tag] = instances
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/health/service/app" || req.URL.Query().Get("passing") != "1" {
+		http.NotFound(w, req)
+		return
+	}
+	c.mu.Lock()
+	changed := c.changed
+	blocking := req.URL.Query().Get("index") == fmt.Sprint(c.index)
+	c.mu.Unlock()
+	if blocking {
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []map[string]interface{}
+	for _, instance := range c.instances[req.URL.Query().Get("tag")] {
+		u, _ := url.Parse("http://" + instance)
+		var port int
+		fmt.Sscan(u.Port(), &port)
+		entries = append(entries, map[string]interface{}{
+			"Node":    map[string]interface{}{"Address": u.Hostname()},
+			"Service": map[string]interface{}{"Port": port, "Weights": map[string]int{"Passing": 1}},
+		})
+	}
+	w.Header().Set("X-Consul-Index", fmt.Sprint(c.index))
+	json.NewEncoder(w).Encode(entries)
+}
+
+// Fake etcd v3 gateway with range and watch
+type fakeEtcd struct {
+	mu       sync.Mutex
+	revision int
+	kvs      map[string]string
+	changed  chan struct{}
+}
+
+func (e *fakeEtcd) put(key, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.kvs[key] = value
+	e.revision++
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+func (e *fakeEtcd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(req.Body).Decode(&body)
+	switch req.URL.Path {
+	case "/v3/kv/range":
+		key, _ := base64.StdEncoding.DecodeString(body["key"].(string))
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		var kvs []map[string]string
+		for k, v := range e.kvs {
+			if strings.HasPrefix(k, string(key)) {
+				kvs = append(kvs, map[string]string{
+					"key":   base64.StdEncoding.EncodeToString([]byte(k)),
+					"value": base64.StdEncoding.EncodeToString([]byte(v)),
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"header": map[string]string{"revision": fmt.Sprint(e.revision)},
+			"kvs":    kvs,
+		})
+	case "/v3/watch":
+		e.mu.Lock()
+		changed := e.changed
+		e.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+		w.(http.Flusher).Flush()
+		select {
+		case <-changed:
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"events": []interface{}{map[string]string{"type": "PUT"}}}})
+		case <-req.Context().Done():
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestDiscoveredPools(t *testing.T) {
+	b1, b2, b3 := newBackend("1"), newBackend("2"), newBackend("3")
+	defer b1.Close()
+	defer b2.Close()
+	defer b3.Close()
+	host := func(b *httptest.Server) string {
+		return strings.TrimPrefix(b.URL, "http://")
+	}
+
+	consul := &fakeConsul{instances: make(map[string][]string), changed: make(chan struct{})}
+	consul.set("east", host(b1))
+	consul.set("west", host(b3))
+	consulSrv := httptest.NewServer(consul)
+	defer consulSrv.Close()
+	etcd := &fakeEtcd{kvs: make(map[string]string), changed: make(chan struct{})}
+	etcd.put("/services/app/north/1", b2.URL+"/north")
+	etcdSrv := httptest.NewServer(etcd)
+	defer etcdSrv.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, consul, etcd string) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs = upstreams, pools, regions
+		cmd.ConsulAddr, cmd.EtcdAddr = consul, etcd
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.ConsulAddr, cmd.EtcdAddr)
+	cmd.Upstreams = nil
+	cmd.ConsulAddr, cmd.EtcdAddr = consulSrv.URL, etcdSrv.URL
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"east":  {Consul: "app/east?tag=east"},
+		"north": {Etcd: "/services/app/north/"},
+	}
+	cmd.RegionConfigs = []cmd.RegionConfig{
+		{ID: 1, Pool: "east", CIDRs: []string{"10.0.0.0/8"}},
+		{ID: 2, Pool: "north", CIDRs: []string{"20.0.0.0/8"}},
+	}
+	p := cmd.NewMultipleHostProxy(&cmd.Env{})
+	defer p.Close()
+	proxy := cmd.NewXffProxy(p)
+
+	get := func(xff string) string {
+		req := prepareRequest(t, "/", 1)
+		req.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		return string(body) + w.Header().Get("X-Path")
+	}
+	assert.Equal(t, "1/east/", get("10.0.0.1"))
+	assert.Equal(t, "2/north/", get("20.0.0.1"))
+
+	// Changes are applied live, watchers keep registry addresses they are created with
+	cmd.ConsulAddr, cmd.EtcdAddr = "http://127.0.0.1:1", "http://127.0.0.1:1"
+	consul.set("east", host(b3))
+	etcd.put("/services/app/north/1", b3.URL+"/north")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "3/east/", get("10.0.0.1"))
+	assert.Equal(t, "3/north/", get("20.0.0.1"))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"expvar"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoDNS(t *testing.T) {
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, defaultRegion int, zone string, dnsTTL int, clientSubnet bool) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DefaultRegion = upstreams, pools, regions, defaultRegion
+		cmd.DNSZone, cmd.DNSTTL, cmd.DNSClientSubnet = zone, dnsTTL, clientSubnet
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DefaultRegion, cmd.DNSZone, cmd.DNSTTL, cmd.DNSClientSubnet)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"east": {Upstreams: []string{"east:80"}},
+		"west": {Upstreams: []string{"west:80"}},
+	}
+	cmd.RegionConfigs = []cmd.RegionConfig{
+		{ID: 1, Pool: "east", CIDRs: []string{"10.0.0.0/8"}, Records: []string{"www A 192.0.2.1", "api CNAME api-east", "@ A 192.0.2.10"}},
+		{ID: 2, Pool: "west", CIDRs: []string{"127.0.0.0/8"}, Records: []string{"www A 198.51.100.1", "www AAAA 2001:db8::1"}},
+		{ID: 3, CIDRs: []string{"192.168.0.0/16"}, Records: []string{"www A 203.0.113.1"}},
+	}
+	cmd.DefaultRegion = 1
+	cmd.DNSZone, cmd.DNSTTL, cmd.DNSClientSubnet = "example.com.", 60, true
+
+	blt, err := bolt.Open("/tmp/regiond-dns.db", 0600, nil)
+	assert.Nil(t, err)
+	defer func() {
+		blt.Close()
+		os.Remove("/tmp/regiond-dns.db")
+	}()
+	d := cmd.NewGeoDNS(&cmd.Env{Blt: blt})
+	defer d.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go d.ServeUDP(conn)
+	go d.ServeTCP(ln)
+	defer d.Shutdown()
+
+	resolver := func(network, addr string) *net.Resolver {
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Local client gets records of its region by UDP and TCP
+	for _, r := range []*net.Resolver{resolver("udp", conn.LocalAddr().String()), resolver("tcp", ln.Addr().String())} {
+		addrs, err := r.LookupHost(ctx, "www.example.com.")
+		assert.Nil(t, err)
+		sort.Strings(addrs)
+		assert.Equal(t, []string{"198.51.100.1", "2001:db8::1"}, addrs)
+	}
+	r := resolver("udp", conn.LocalAddr().String())
+
+	// Names missing in client region are answered with records of default region
+	addrs, err := r.LookupHost(ctx, "example.com.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.10"}, addrs)
+	cname, err := r.LookupCNAME(ctx, "api.example.com.")
+	assert.Nil(t, err)
+	assert.Equal(t, "api-east.example.com.", cname)
+
+	// Unknown names don't exist
+	_, err = r.LookupHost(ctx, "missing.example.com.")
+	dnsErr, ok := err.(*net.DNSError)
+	assert.True(t, ok)
+	assert.True(t, dnsErr.IsNotFound)
+
+	// Region is resolved by EDNS Client Subnet if query has one
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+	exchange := func(query []byte) []byte {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := c.Write(query)
+		assert.Nil(t, err)
+		resp := make([]byte, 512)
+		n, err := c.Read(resp)
+		assert.Nil(t, err)
+		return resp[:n]
+	}
+	// Query of www with OPT record with client subnet option of family 1, source prefix and address
+	subnetQuery := func(prefix byte, address ...byte) []byte {
+		query := []byte{0, 42, 1, 0, 0, 1, 0, 0, 0, 0, 0, 1, 3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+		query = append(query, 0, 0, 41, 4, 208, 0, 0, 0, 0, 0, byte(8+len(address)), 0, 8, 0, byte(4+len(address)), 0, 1, prefix, 0)
+		return append(query, address...)
+	}
+	resp := exchange(subnetQuery(24, 10, 1, 2))
+	assert.Equal(t, uint16(42), binary.BigEndian.Uint16(resp))
+	assert.Equal(t, uint16(1), binary.BigEndian.Uint16(resp[6:]))
+	// Answer follows 12 bytes of header and 21 bytes of question, its address follows 12 bytes of record header
+	assert.Equal(t, []byte{192, 0, 2, 1}, resp[12+21+12:12+21+16])
+	// Client subnet is echoed with scope
+	assert.Equal(t, []byte{0, 1, 24, 24, 10, 1, 2}, resp[len(resp)-7:])
+
+	// Region without pool is answered with its records
+	resp = exchange(subnetQuery(24, 192, 168, 1))
+	assert.Equal(t, []byte{203, 0, 113, 1}, resp[12+21+12:12+21+16])
+
+	// Client subnet with zero source prefix is ignored, so region is resolved by resolver address
+	resp = exchange(subnetQuery(0))
+	assert.Equal(t, []byte{198, 51, 100, 1}, resp[12+21+12:12+21+16])
+
+	// Questions of other classes are refused for zone apex too
+	resp = exchange([]byte{0, 43, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 3})
+	assert.Equal(t, uint16(5), binary.BigEndian.Uint16(resp[2:])&0xf)
+
+	stats := expvar.Get("dns").(*expvar.Map)
+	assert.Equal(t, "2", stats.Get("client-subnet").String())
+	assert.NotNil(t, stats.Get("region.1.queries"))
+	assert.NotNil(t, stats.Get("nxdomain"))
+}
+
+func TestGeoDNSWithoutPools(t *testing.T) {
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, defaultRegion int, zone string) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DefaultRegion = upstreams, pools, regions, defaultRegion
+		cmd.DNSZone = zone
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DefaultRegion, cmd.DNSZone)
+	cmd.Upstreams, cmd.Pools = nil, nil
+	cmd.RegionConfigs = []cmd.RegionConfig{
+		{ID: 1, CIDRs: []string{"10.0.0.0/8"}, Records: []string{"www A 192.0.2.1"}},
+		{ID: 2, CIDRs: []string{"127.0.0.0/8"}, Records: []string{"www A 198.51.100.1"}},
+	}
+	cmd.DefaultRegion = 1
+	cmd.DNSZone = "example.com."
+
+	// Regions are answered with their records without upstreams
+	d := cmd.NewGeoDNS(&cmd.Env{})
+	defer d.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go d.ServeUDP(conn)
+	defer d.Shutdown()
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := r.LookupHost(ctx, "www.example.com.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"198.51.100.1"}, addrs)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Backend-Version", "1.2.3")
+		w.Header().Set("X-Region-Id", req.Header.Get("X-Region-Id"))
+		w.Header().Set("X-Client", req.Header.Get("X-Client"))
+		w.Header().Set("X-Tenant", req.Header.Get("X-Tenant"))
+		w.Header().Set("X-Internal", req.Header.Get("X-Internal"))
+		w.Header().Set("X-Forwarded", req.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, routes []cmd.RouteConfig, headers cmd.HeadersConfig) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.RouteConfigs, cmd.Headers = upstreams, pools, regions, routes, headers
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.RouteConfigs, cmd.Headers)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{"main": {Upstreams: []string{backend.URL}}}
+	cmd.RegionConfigs = []cmd.RegionConfig{
+		{ID: 1, Pool: "main", CIDRs: []string{"10.0.0.0/8"}},
+		{ID: 2, Pool: "main", CIDRs: []string{"20.0.0.0/8"}, Headers: &cmd.HeadersConfig{
+			Request: cmd.HeaderRules{Set: map[string]string{"x-tenant": "east-{pool}"}},
+		}},
+	}
+	cmd.RouteConfigs = []cmd.RouteConfig{{
+		Name:    "api",
+		Path:    "/api",
+		Regions: []cmd.RegionConfig{{ID: 2, Pool: "main", CIDRs: []string{"20.0.0.0/8"}}},
+		Headers: &cmd.HeadersConfig{Request: cmd.HeaderRules{Set: map[string]string{"X-Tenant": "api"}}},
+	}}
+	cmd.Headers = cmd.HeadersConfig{
+		Request: cmd.HeaderRules{
+			Remove: []string{"X-Internal", "x-forwarded-for"},
+			Set:    map[string]string{"X-Region-Id": "{region}", "X-Tenant": "global"},
+			Add:    map[string]string{"X-Client": "{client-ip}/{route}"},
+		},
+		// Names are lower case as in config file
+		Response: cmd.HeaderRules{Remove: []string{"X-Backend-Version"}, Set: map[string]string{"x-served-by": "{upstream}"}},
+	}
+	p := cmd.NewMultipleHostProxy(&cmd.Env{})
+	defer p.Close()
+	proxy := cmd.NewXffProxy(p)
+
+	get := func(path string) http.Header {
+		req := prepareRequest(t, path, 1)
+		req.Header.Set("X-Internal", "secret")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		return w.Header()
+	}
+
+	// Global rules apply to all requests, region rules override them
+	h := get("/")
+	assert.Equal(t, "2", h.Get("X-Region-Id"))
+	assert.Equal(t, "20.0.0.1/", h.Get("X-Client"))
+	assert.Equal(t, "east-main", h.Get("X-Tenant"))
+	assert.Equal(t, "", h.Get("X-Internal"))
+	assert.Equal(t, "", h.Get("X-Forwarded"))
+	assert.Equal(t, "", h.Get("X-Backend-Version"))
+	assert.Equal(t, []string{backend.Listener.Addr().String()}, h["X-Served-By"])
+
+	// Route rules override global ones
+	h = get("/api/users")
+	assert.Equal(t, "api", h.Get("X-Tenant"))
+	assert.Equal(t, "20.0.0.1/api", h.Get("X-Client"))
+
+	// Unknown placeholders are rejected
+	cmd.Headers.Request.Set["X-Bad"] = "{unknown}"
+	_, err := cmd.NewRouting(&cmd.Env{})
+	assert.NotNil(t, err)
+}
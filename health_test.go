@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dddpaul/regiond/cache"
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailover(t *testing.T) {
+	down := map[string]*atomic.Bool{"central": {}, "east1": {}, "east2": {}, "west": {}}
+	central, east1 := newHealthBackend("central", down["central"]), newHealthBackend("east1", down["east1"])
+	east2, west := newHealthBackend("east2", down["east2"]), newHealthBackend("west", down["west"])
+	defer central.Close()
+	defer east1.Close()
+	defer east2.Close()
+	defer west.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, defaultRegion int, healthPath string, healthInterval, healthTimeout time.Duration, healthThreshold int) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DefaultRegion = upstreams, pools, regions, defaultRegion
+		cmd.HealthPath, cmd.HealthInterval, cmd.HealthTimeout, cmd.HealthThreshold = healthPath, healthInterval, healthTimeout, healthThreshold
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DefaultRegion, cmd.HealthPath, cmd.HealthInterval, cmd.HealthTimeout, cmd.HealthThreshold)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"central": {Upstreams: []string{central.URL}},
+		"east":    {Upstreams: []string{east1.URL, east2.URL}},
+		"west":    {Upstreams: []string{west.URL}},
+	}
+	cmd.RegionConfigs = []cmd.RegionConfig{
+		{ID: 1, Pool: "central", CIDRs: []string{"10.0.0.0/8"}},
+		{ID: 2, Pool: "east", CIDRs: []string{"20.0.0.0/8"}, Failover: []int{3}},
+		{ID: 3, Pool: "west", CIDRs: []string{"30.0.0.0/8"}},
+	}
+	cmd.DefaultRegion = 1
+	cmd.HealthPath, cmd.HealthInterval, cmd.HealthTimeout, cmd.HealthThreshold = "/health", 20*time.Millisecond, time.Second, 1
+
+	blt, err := bolt.Open("/tmp/regiond-failover.db", 0600, nil)
+	assert.Nil(t, err)
+	defer func() {
+		blt.Close()
+		os.Remove("/tmp/regiond-failover.db")
+	}()
+	p := cmd.NewMultipleHostProxy(&cmd.Env{Blt: blt})
+	defer p.Close()
+	proxy := cmd.NewXffProxy(p)
+
+	get := func() string {
+		req := prepareRequest(t, "/", 1)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	// Health is changed by checks in background
+	await := func(expected string) {
+		for i := 0; i < 200 && get() != expected; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, expected, get())
+	}
+
+	original := get()
+	other := map[string]string{"east1": "east2", "east2": "east1"}[original]
+	assert.NotEmpty(t, other)
+	cached := string(cache.Get(blt, "20.0.0.1"))
+
+	// Unhealthy upstream is replaced by another one of the same pool
+	down[original].Store(true)
+	await(other)
+
+	// Clients of region without healthy upstreams go through failover chain up to default region
+	down[other].Store(true)
+	await("west")
+	down["west"].Store(true)
+	await("central")
+
+	// Clients fail back to their upstream and keep their cache entries
+	down[original].Store(false)
+	await(original)
+	assert.Equal(t, cached, string(cache.Get(blt, "20.0.0.1")))
+}
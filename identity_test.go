@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dddpaul/regiond/cache"
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityRouting(t *testing.T) {
+	office, acme, globex := newBackend("office"), newBackend("acme"), newBackend("globex")
+	defer office.Close()
+	defer acme.Close()
+	defer globex.Close()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "rsa1",
+		"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}}})
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile("/tmp/regiond-jwks.json", jwks, 0600))
+	defer os.Remove("/tmp/regiond-jwks.json")
+
+	apiKey := sha256.Sum256([]byte("globex-api-key"))
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, claim, jwks string, jwtKeys []string, apiKeyHeader string) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs = upstreams, pools, regions
+		cmd.JWTClaim, cmd.JWKSFile, cmd.JWTKeys, cmd.APIKeyHeader = claim, jwks, jwtKeys, apiKeyHeader
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.JWTClaim, cmd.JWKSFile, cmd.JWTKeys, cmd.APIKeyHeader)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"office": {Upstreams: []string{office.URL}},
+		"acme":   {Upstreams: []string{acme.URL}},
+		"globex": {Upstreams: []string{globex.URL}},
+	}
+	cmd.RegionConfigs = []cmd.RegionConfig{
+		{ID: 1, Pool: "office", CIDRs: []string{"20.0.0.0/8"}},
+		{ID: 2, Pool: "acme", Identities: []string{"acme"}},
+		{ID: 3, Pool: "globex", Identities: []string{hex.EncodeToString(apiKey[:])}},
+	}
+	cmd.JWTClaim, cmd.JWKSFile, cmd.JWTKeys, cmd.APIKeyHeader = "tenant", "/tmp/regiond-jwks.json", []string{"secret"}, "X-Api-Key"
+
+	blt, err := bolt.Open("/tmp/regiond-identity.db", 0600, nil)
+	assert.Nil(t, err)
+	defer func() {
+		blt.Close()
+		os.Remove("/tmp/regiond-identity.db")
+	}()
+	p := cmd.NewMultipleHostProxy(&cmd.Env{Blt: blt})
+	proxy := cmd.NewXffProxy(p)
+
+	token := func(alg string, claims map[string]interface{}, sign func(string) []byte) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "rsa1"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+	}
+	hs256 := func(key string) func(string) []byte {
+		return func(signed string) []byte {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(signed))
+			return mac.Sum(nil)
+		}
+	}
+	rs256 := func(signed string) []byte {
+		sum := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		return sig
+	}
+	valid := map[string]interface{}{"tenant": "acme", "exp": time.Now().Add(time.Hour).Unix()}
+	expired := map[string]interface{}{"tenant": "acme", "exp": time.Now().Add(-time.Hour).Unix()}
+
+	// Clients behind the same IP are routed by their identities, invalid tokens fall back to IP
+	cases := []struct {
+		name, header, value, pool string
+	}{
+		{"no identity", "", "", "office"},
+		{"HMAC token", "Authorization", "Bearer " + token("HS256", valid, hs256("secret")), "acme"},
+		{"JWKS token", "Authorization", "Bearer " + token("RS256", valid, rs256), "acme"},
+		{"wrong key", "Authorization", "Bearer " + token("HS256", valid, hs256("wrong")), "office"},
+		{"expired token", "Authorization", "Bearer " + token("RS256", expired, rs256), "office"},
+		{"API key", "X-Api-Key", "globex-api-key", "globex"},
+		{"unknown API key", "X-Api-Key", "unknown", "office"},
+	}
+	for _, c := range cases {
+		req := prepareRequest(t, "/", 1)
+		if c.header != "" {
+			req.Header.Set(c.header, c.value)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		assert.Equal(t, c.pool, string(body), c.name)
+	}
+
+	// Clients are cached by identity, API keys are cached by digest only
+	assert.NotNil(t, cache.Get(blt, "jwt:acme"))
+	assert.NotNil(t, cache.Get(blt, "key:"+hex.EncodeToString(apiKey[:])))
+	assert.NotNil(t, cache.Get(blt, "20.0.0.1"))
+	assert.Nil(t, cache.Get(blt, "globex-api-key"))
+	unknownKey := sha256.Sum256([]byte("unknown"))
+	assert.Nil(t, cache.Get(blt, "key:"+hex.EncodeToString(unknownKey[:])))
+	assert.NotNil(t, expvar.Get("identity").(*expvar.Map).Get("unknown"))
+}
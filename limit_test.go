@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyIsLimitingRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	defer func(upstreams, regionLimits []string, clientLimit string) {
+		cmd.Upstreams, cmd.RegionLimits, cmd.ClientLimit = upstreams, regionLimits, clientLimit
+	}(cmd.Upstreams, cmd.RegionLimits, cmd.ClientLimit)
+	cmd.Upstreams = []string{backend.URL}
+	cmd.RegionLimits = []string{"*=0.1/2"}
+	cmd.ClientLimit = "0.1/1"
+	proxy := cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{}))
+
+	// Second request of the same client exceeds client limit
+	codes := []int{200, 429}
+	for _, code := range codes {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, prepareRequest(t, "/", 1))
+		assert.Equal(t, code, w.Code)
+	}
+
+	// Region bucket has one token left for another client
+	codes = []int{200, 429}
+	for i, code := range codes {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, prepareRequest(t, "/", i+2))
+		assert.Equal(t, code, w.Code)
+		if code == 429 {
+			assert.Equal(t, "10", w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestClientLimitIsSharedByRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, routes []cmd.RouteConfig, clientLimit string) {
+		cmd.Upstreams, cmd.Pools, cmd.RouteConfigs, cmd.ClientLimit = upstreams, pools, routes, clientLimit
+	}(cmd.Upstreams, cmd.Pools, cmd.RouteConfigs, cmd.ClientLimit)
+	cmd.Pools = map[string]cmd.PoolConfig{"backend": {Upstreams: []string{backend.URL}}}
+	cmd.RouteConfigs = []cmd.RouteConfig{
+		{Name: "api", Path: "/api", Regions: []cmd.RegionConfig{{ID: 1, Pool: "backend"}}},
+		{Name: "blog", Path: "/blog", Regions: []cmd.RegionConfig{{ID: 1, Pool: "backend"}}},
+	}
+	cmd.ClientLimit = "0.1/1"
+	proxy := cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{}))
+
+	// Client which spent its token on one route is limited on another one
+	paths, codes := []string{"/api", "/blog"}, []int{200, 429}
+	for i, path := range paths {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, prepareRequest(t, path, 1))
+		assert.Equal(t, codes[i], w.Code, path)
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	opts, err := cmd.ParseLimit("10")
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.LimitOptions{Rate: 10, Burst: 10}, opts)
+
+	opts, err = cmd.ParseLimit("0.5/5/20")
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.LimitOptions{Rate: 0.5, Burst: 5, MaxInFlight: 20}, opts)
+
+	opts, err = cmd.ParseLimit("//3")
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.LimitOptions{MaxInFlight: 3}, opts)
+
+	_, err = cmd.ParseLimit("a/b")
+	assert.NotNil(t, err)
+}
+
+func TestRegionRejectionKeepsClientTokens(t *testing.T) {
+	l, err := cmd.NewLimiter([]string{"1=0.001/1/0", "2=100/100/0"}, "0.001/2/0")
+	assert.Nil(t, err)
+	release, _ := l.Acquire(1, "10.0.0.1")
+	assert.NotNil(t, release)
+	// Region rejects request, so client token is returned and client may use it in another region
+	release, _ = l.Acquire(1, "10.0.0.1")
+	assert.Nil(t, release)
+	release, _ = l.Acquire(2, "10.0.0.1")
+	assert.NotNil(t, release)
+	release, _ = l.Acquire(2, "10.0.0.1")
+	assert.Nil(t, release)
+}
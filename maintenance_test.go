@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/dddpaul/regiond/cache"
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenance(t *testing.T) {
+	b1, b2, b3 := newBackend("1"), newBackend("2"), newBackend("3")
+	defer b1.Close()
+	defer b2.Close()
+	defer b3.Close()
+
+	defer func(upstreams, regionCIDRs []string, maintenance []cmd.MaintenanceConfig) {
+		cmd.Upstreams, cmd.RegionCIDRs, cmd.MaintenanceConfigs = upstreams, regionCIDRs, maintenance
+	}(cmd.Upstreams, cmd.RegionCIDRs, cmd.MaintenanceConfigs)
+	cmd.Upstreams = []string{b1.URL, b2.URL, b3.URL}
+	cmd.RegionCIDRs = []string{"10.0.0.0/8=1", "20.0.0.0/8=2", "30.0.0.0/8=3"}
+	cmd.MaintenanceConfigs = []cmd.MaintenanceConfig{{
+		Region:     2,
+		RetryAfter: 600,
+		Response:   cmd.AccessResponse{Body: `{"error": "maintenance"}`, ContentType: "application/json"},
+	}}
+
+	blt, err := bolt.Open("/tmp/regiond-maintenance.db", 0600, nil)
+	assert.Nil(t, err)
+	defer func() {
+		blt.Close()
+		os.Remove("/tmp/regiond-maintenance.db")
+	}()
+	p := cmd.NewMultipleHostProxy(&cmd.Env{Blt: blt})
+	proxy := cmd.NewXffProxy(p)
+	admin := httptest.NewServer(cmd.NewAdminHandler(p))
+	defer admin.Close()
+
+	get := func(xff string) *httptest.ResponseRecorder {
+		req := prepareRequest(t, "/", 1)
+		req.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	call := func(method, query, body string) int {
+		req, _ := http.NewRequest(method, admin.URL+"/maintenance"+query, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	w := get("20.0.0.1")
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "600", w.Header().Get("Retry-After"))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"error": "maintenance"}`, w.Body.String())
+	assert.Equal(t, "1", get("10.0.0.1").Body.String())
+
+	// Clients of region in maintenance are sent to fallback region, their cache entries are kept
+	assert.Equal(t, 200, call("PUT", "", `{"region": 2, "fallback-region": 3}`))
+	assert.Equal(t, "3", get("20.0.0.1").Body.String())
+	assert.Contains(t, string(cache.Get(blt, "20.0.0.1")), `"region":2`)
+
+	// Single upstream is put into maintenance
+	assert.Equal(t, 200, call("PUT", "", `{"upstream": "`+b1.URL+`"}`))
+	assert.Equal(t, 503, get("10.0.0.1").Code)
+	assert.Equal(t, 200, call("DELETE", "?upstream="+b1.URL, ""))
+	assert.Equal(t, "1", get("10.0.0.1").Body.String())
+
+	// Clients return to their region when maintenance is over
+	assert.Equal(t, 200, call("DELETE", "?region=2", ""))
+	assert.Equal(t, "2", get("20.0.0.1").Body.String())
+
+	assert.Equal(t, 404, call("DELETE", "?region=2", ""))
+	assert.Equal(t, 400, call("PUT", "", `{"region": 5}`))
+	assert.Equal(t, 400, call("PUT", "", `{"region": 2, "fallback-region": 2}`))
+}
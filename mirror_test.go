@@ -0,0 +1,78 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer primary.Close()
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mirrored <- req.Method + " " + req.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, mirrorBodyLimit int64) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.MirrorBodyLimit = upstreams, pools, regions, mirrorBodyLimit
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.MirrorBodyLimit)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"stable": {Upstreams: []string{primary.URL}},
+		"next":   {Upstreams: []string{shadow.URL}},
+	}
+	cmd.RegionConfigs = []cmd.RegionConfig{{ID: 1, Pool: "stable", Mirror: &cmd.MirrorConfig{Pool: "next", Percent: 100}}}
+	cmd.MirrorBodyLimit = 16
+	p := cmd.NewMultipleHostProxy(&cmd.Env{})
+	defer p.Close()
+	proxy := cmd.NewXffProxy(p)
+
+	post := func(body string) string {
+		req, err := http.NewRequest("POST", "/submit", strings.NewReader(body))
+		assert.Nil(t, err)
+		req.RemoteAddr = "10.0.0.1:40001"
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		return w.Body.String()
+	}
+
+	// Both primary and shadow pools get request body, client gets primary response
+	assert.Equal(t, "hello", post("hello"))
+	select {
+	case r := <-mirrored:
+		assert.Equal(t, "POST /submit hello", r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request is not mirrored")
+	}
+	stats := expvar.Get("mirror").(*expvar.Map)
+	for i := 0; i < 500 && stats.Get("region.1.status.mismatch") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, stats.Get("region.1.status.mismatch"))
+	assert.NotNil(t, stats.Get("region.1.shadow-ms"))
+
+	// Request with body over limit is not mirrored, primary request is unaffected
+	large := strings.Repeat("x", 100)
+	assert.Equal(t, large, post(large))
+	select {
+	case r := <-mirrored:
+		t.Fatalf("request is mirrored: %s", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, "1", stats.Get("region.1.skipped").String())
+}
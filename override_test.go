@@ -0,0 +1,64 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegionOverride(t *testing.T) {
+	b1, b2 := newBackend("1"), newBackend("2")
+	defer b1.Close()
+	defer b2.Close()
+
+	defer func(upstreams, regionCIDRs []string, overrideHeader, overrideCookie, overrideQuery string, overrideTrusted []string, overrideKey string) {
+		cmd.Upstreams, cmd.RegionCIDRs = upstreams, regionCIDRs
+		cmd.OverrideHeader, cmd.OverrideCookie, cmd.OverrideQuery = overrideHeader, overrideCookie, overrideQuery
+		cmd.OverrideTrusted, cmd.OverrideKey = overrideTrusted, overrideKey
+	}(cmd.Upstreams, cmd.RegionCIDRs, cmd.OverrideHeader, cmd.OverrideCookie, cmd.OverrideQuery, cmd.OverrideTrusted, cmd.OverrideKey)
+	cmd.Upstreams = []string{b1.URL, b2.URL}
+	cmd.RegionCIDRs = []string{"20.0.0.0/8=1"}
+	cmd.OverrideHeader, cmd.OverrideCookie, cmd.OverrideQuery = "X-Regiond-Region", "region", "region"
+	cmd.OverrideTrusted = []string{"30.0.0.0/8"}
+	cmd.OverrideKey = "secret"
+	proxy := cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{}))
+
+	get := func(xff string, prepare func(req *http.Request)) string {
+		req := prepareRequest(t, "/", 1)
+		req.Header.Set("X-Forwarded-For", xff)
+		prepare(req)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		return string(body)
+	}
+	header := func(v string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("X-Regiond-Region", v) }
+	}
+
+	// Plain region is accepted from trusted clients only
+	assert.Equal(t, "2", get("30.0.0.1", header("2")))
+	assert.Equal(t, "1", get("20.0.0.1", header("2")))
+	assert.Equal(t, "2", get("30.0.0.1", func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: "region", Value: "2"})
+	}))
+	assert.Equal(t, "2", get("30.0.0.1", func(req *http.Request) {
+		req.URL.RawQuery = "region=2"
+	}))
+
+	// Signed token is accepted from any client until it expires
+	token := cmd.SignOverride("secret", 2, time.Now().Add(time.Hour))
+	assert.Equal(t, "2", get("20.0.0.1", header(token)))
+	assert.Equal(t, "1", get("20.0.0.1", header(cmd.SignOverride("secret", 2, time.Now().Add(-time.Hour)))))
+	assert.Equal(t, "1", get("20.0.0.1", header(cmd.SignOverride("wrong", 2, time.Now().Add(time.Hour)))))
+
+	stats := expvar.Get("overrides").(*expvar.Map)
+	assert.NotNil(t, stats.Get("header"))
+	assert.NotNil(t, stats.Get("header.rejected"))
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 
 	"time"
@@ -16,6 +18,7 @@ import (
 	"github.com/dddpaul/regiond/cmd"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
 	"net"
 )
 
@@ -29,6 +32,9 @@ func TestProxyIsCachingUpstreams(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Set proxy parameters
+	defer func(upstreams []string, ttl int64) {
+		cmd.Upstreams, cmd.TTL = upstreams, ttl
+	}(cmd.Upstreams, cmd.TTL)
 	cmd.Upstreams = []string{"localhost:9091", "localhost:9092"}
 	cmd.TTL = 1
 
@@ -117,6 +123,9 @@ func TestProxyIsRequestingOracle(t *testing.T) {
 	}
 
 	// Set proxy parameters
+	defer func(upstreams []string) {
+		cmd.Upstreams = upstreams
+	}(cmd.Upstreams)
 	cmd.Upstreams = []string{"localhost:9093", "localhost:9094"}
 
 	// Setup Oracle database client
@@ -147,6 +156,51 @@ func prepareRequest(t *testing.T, url string, i int) *http.Request {
 	return req
 }
 
+// Backend answers with its name and tells request path in X-Path header
+func newBackend(name string) *httptest.Server {
+	return newHealthBackend(name, nil)
+}
+
+// Health checks of backend fail while down is set
+func newHealthBackend(name string, down *atomic.Bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if down != nil && down.Load() && req.URL.Path == "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Path", req.URL.Path)
+		w.Write([]byte(name))
+	}))
+}
+
+// TCP backend greets client with its name and echoes data until client half-closes connection
+func newTCPBackend(t *testing.T, name string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte(name + ":"))
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+// WebSocket backend greets client with its name and echoes messages
+func newWebSocketBackend(name string) *httptest.Server {
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		websocket.Message.Send(ws, name)
+		io.Copy(ws, ws)
+	}))
+}
+
 func createOracleContainer(t *testing.T, client *docker.Client) *docker.Container {
 	portBindings := map[docker.Port][]docker.PortBinding{"1521/tcp": {{HostIP: "0.0.0.0", HostPort: "1521"}}}
 	client.CreateVolume(docker.CreateVolumeOptions{})
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirect(t *testing.T) {
+	backend := newBackend("proxied")
+	defer backend.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs = upstreams, pools, regions
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{"main": {Upstreams: []string{backend.URL}}}
+	cmd.RegionConfigs = []cmd.RegionConfig{
+		{ID: 1, Pool: "main", CIDRs: []string{"10.0.0.0/8"}},
+		{ID: 2, Pool: "main", CIDRs: []string{"20.0.0.0/8"}, Redirect: &cmd.RedirectConfig{
+			URL:    "https://east.example.com/dl?token=1",
+			Status: http.StatusTemporaryRedirect,
+			Paths:  []string{"/files/"},
+		}},
+	}
+	p := cmd.NewMultipleHostProxy(&cmd.Env{})
+	defer p.Close()
+	proxy := cmd.NewXffProxy(p)
+
+	serve := func(method string, path string) *httptest.ResponseRecorder {
+		req := prepareRequest(t, path, 1)
+		req.Method = method
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	// Matching requests are redirected to region base URL with their path and query
+	w := serve("GET", "/files/big.iso?part=2")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "https://east.example.com/dl/files/big.iso?token=1&part=2", w.Header().Get("Location"))
+
+	// Escaped slashes and question marks are kept
+	w = serve("GET", "/files/a%2Fb%3Fc.iso")
+	assert.Equal(t, "https://east.example.com/dl/files/a%2Fb%3Fc.iso?token=1", w.Header().Get("Location"))
+
+	// Other paths and methods are proxied
+	w = serve("GET", "/api")
+	assert.Equal(t, "proxied", w.Body.String())
+	w = serve("GET", "/files-old/big.iso")
+	assert.Equal(t, "proxied", w.Body.String())
+	w = serve("POST", "/files/upload")
+	assert.Equal(t, "proxied", w.Body.String())
+
+	// Clients of regions without redirect are proxied
+	req := prepareRequest(t, "/files/big.iso", 1)
+	req.Header.Del("X-Forwarded-For")
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	assert.Equal(t, "proxied", rec.Body.String())
+
+	stats := expvar.Get("redirect").(*expvar.Map)
+	assert.Equal(t, "2", stats.Get("region.2.redirected").String())
+
+	// Paths not starting with '/' and invalid status are rejected
+	cmd.RegionConfigs[1].Redirect.Paths = []string{"files"}
+	_, err := cmd.NewRouting(&cmd.Env{})
+	assert.NotNil(t, err)
+	cmd.RegionConfigs[1].Redirect.Paths = nil
+	cmd.RegionConfigs[1].Redirect.Status = http.StatusOK
+	_, err = cmd.NewRouting(&cmd.Env{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/dddpaul/regiond/cache"
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyRoutesMixedIPv4AndIPv6Clients(t *testing.T) {
+	b1, b2 := newBackend("1"), newBackend("2")
+	defer b1.Close()
+	defer b2.Close()
+
+	defer func(upstreams, regionCIDRs []string, ttl int64, ipv6Prefix int) {
+		cmd.Upstreams, cmd.RegionCIDRs = upstreams, regionCIDRs
+		cmd.TTL = ttl
+		cmd.IPv6Prefix = ipv6Prefix
+	}(cmd.Upstreams, cmd.RegionCIDRs, cmd.TTL, cmd.IPv6Prefix)
+	cmd.Upstreams = []string{b1.URL, b2.URL}
+	cmd.TTL = 60
+	cmd.RegionCIDRs = []string{"20.0.0.0/8=1", "2001:db8::/32=1", "2001:db8:2::/48=2", "::ffff:30.0.0.0/104=2"}
+	cmd.IPv6Prefix = 64
+
+	blt, err := bolt.Open("/tmp/regiond-ipv6.db", 0600, nil)
+	assert.Nil(t, err)
+	defer func() {
+		blt.Close()
+		os.Remove("/tmp/regiond-ipv6.db")
+	}()
+	proxy := cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{Blt: blt}))
+
+	cases := []struct {
+		remoteAddr string
+		xff        string
+		upstream   string
+	}{
+		{"[2001:db8:1::1]:4000", "", "1"},
+		{"[2001:db8:2::1]:4000", "", "2"},
+		{"[2001:db8:2::2]:4000", "", "2"},
+		{"10.0.0.1:4000", "2001:0db8:0001:0000::0005", "1"},
+		{"[::1]:4000", "20.0.0.1", "1"},
+		{"[::ffff:30.0.0.1]:4000", "", "2"},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", "/", nil)
+		assert.Nil(t, err)
+		req.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		body, _ := ioutil.ReadAll(w.Body)
+		assert.Equal(t, c.upstream, string(body), c.remoteAddr)
+	}
+
+	// IPv6 clients are cached by /64 networks in canonical form
+	assert.Len(t, cache.PrefixScan(blt, "2001:db8:"), 2)
+	assert.NotNil(t, cache.Get(blt, "2001:db8:2::/64"))
+	assert.NotNil(t, cache.Get(blt, "2001:db8:1::/64"))
+	assert.NotNil(t, cache.Get(blt, "20.0.0.1"))
+	assert.NotNil(t, cache.Get(blt, "30.0.0.1"))
+}
+
+func TestClientKey(t *testing.T) {
+	assert.Equal(t, "20.0.0.1", cmd.ClientKey("20.0.0.1", 64))
+	assert.Equal(t, "20.0.0.1", cmd.ClientKey("::ffff:20.0.0.1", 64))
+	assert.Equal(t, "2001:db8::1", cmd.ClientKey("2001:0DB8::0001", 0))
+	assert.Equal(t, "2001:db8:0:1::/64", cmd.ClientKey("2001:db8:0:1:2:3:4:5", 64))
+	assert.Equal(t, "@", cmd.ClientKey("@", 64))
+}
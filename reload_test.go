@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyReloadsConfig(t *testing.T) {
+	release := make(chan bool)
+	b1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("1"))
+	}))
+	defer b1.Close()
+	b2 := newBackend("2")
+	defer b2.Close()
+
+	dir, err := ioutil.TempDir("", "regiond-reload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fn := dir + "/regiond.yaml"
+	writeConfig := func(upstream string, pool string) {
+		cfg := "ttl: 60\npools:\n  main:\n    upstreams: [\"" + upstream + "\"]\nregions:\n  - id: 1\n    pool: " + pool + "\n"
+		assert.Nil(t, ioutil.WriteFile(fn, []byte(cfg), 0600))
+	}
+	writeConfig(b1.URL, "main")
+
+	c, _, err := cmd.RootCmd.Find([]string{"proxy"})
+	assert.Nil(t, err)
+	viper.SetConfigFile(fn)
+	assert.Nil(t, viper.ReadInConfig())
+	defer resetConfig(c)
+	defer func(upstreams []string, ttl int64, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, resolvers []cmd.ResolverConfig, routes []cmd.RouteConfig, access []cmd.AccessConfig, maintenance []cmd.MaintenanceConfig, headers cmd.HeadersConfig) {
+		cmd.Upstreams, cmd.TTL = upstreams, ttl
+		cmd.Pools, cmd.RegionConfigs, cmd.ResolverConfigs, cmd.RouteConfigs = pools, regions, resolvers, routes
+		cmd.AccessConfigs, cmd.MaintenanceConfigs, cmd.Headers = access, maintenance, headers
+	}(cmd.Upstreams, cmd.TTL, cmd.Pools, cmd.RegionConfigs, cmd.ResolverConfigs, cmd.RouteConfigs, cmd.AccessConfigs, cmd.MaintenanceConfigs, cmd.Headers)
+	cmd.Upstreams = nil
+
+	assert.Nil(t, c.ParseFlags([]string{}))
+	assert.Nil(t, cmd.ApplyConfig(c.Flags()))
+	p := cmd.NewMultipleHostProxy(&cmd.Env{})
+	proxy := cmd.NewXffProxy(p)
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, prepareRequest(t, path, 1))
+		return w.Body.String()
+	}
+	assert.Equal(t, "1", get("/"))
+
+	// Request in flight must be finished with the upstream it was started with
+	slow := make(chan string)
+	go func() {
+		slow <- get("/slow")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	writeConfig(b2.URL, "main")
+	assert.Nil(t, p.Reload(c.Flags()))
+	assert.Equal(t, "2", get("/"))
+	close(release)
+	assert.Equal(t, "1", <-slow)
+
+	// Invalid config must be rejected, current one is kept
+	writeConfig(b1.URL, "unknown")
+	assert.NotNil(t, p.Reload(c.Flags()))
+	assert.Equal(t, "2", get("/"))
+	assert.Equal(t, []string{b2.URL}, cmd.Pools["main"].Upstreams)
+}
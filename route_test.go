@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/dddpaul/regiond/cache"
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualRoutes(t *testing.T) {
+	shop1, shop2, api, blog := newBackend("shop1"), newBackend("shop2"), newBackend("api"), newBackend("blog")
+	defer shop1.Close()
+	defer shop2.Close()
+	defer api.Close()
+	defer blog.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, routes []cmd.RouteConfig, defaultRoute string) {
+		cmd.Upstreams, cmd.Pools, cmd.RouteConfigs, cmd.DefaultRoute = upstreams, pools, routes, defaultRoute
+	}(cmd.Upstreams, cmd.Pools, cmd.RouteConfigs, cmd.DefaultRoute)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"shop1": {Upstreams: []string{shop1.URL}},
+		"shop2": {Upstreams: []string{shop2.URL}},
+		"api":   {Upstreams: []string{api.URL}},
+		"blog":  {Upstreams: []string{blog.URL}},
+	}
+	cmd.RouteConfigs = []cmd.RouteConfig{
+		{Name: "shop", Host: "shop.example.com", TTL: 60, DefaultRegion: 1, Regions: []cmd.RegionConfig{
+			{ID: 1, Pool: "shop1"},
+			{ID: 2, Pool: "shop2", CIDRs: []string{"20.0.0.0/8"}},
+		}},
+		{Name: "api", Host: "*.example.com", Path: "/api", Regions: []cmd.RegionConfig{{ID: 1, Pool: "api"}}},
+		{Name: "blog", Path: "/blog", Regions: []cmd.RegionConfig{{ID: 1, Pool: "blog"}}},
+	}
+
+	blt, err := bolt.Open("/tmp/regiond-routes.db", 0600, nil)
+	assert.Nil(t, err)
+	defer func() {
+		blt.Close()
+		os.Remove("/tmp/regiond-routes.db")
+	}()
+	proxy := cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{Blt: blt}))
+
+	get := func(host, path, xff string) (int, string) {
+		req := prepareRequest(t, path, 1)
+		req.Host = host
+		req.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		return w.Code, string(body)
+	}
+	cases := []struct {
+		host, path, xff string
+		code            int
+		body            string
+	}{
+		{"shop.example.com", "/", "10.0.0.1", 200, "shop1"},
+		{"SHOP.example.com:8080", "/cart", "20.0.0.1", 200, "shop2"},
+		{"www.example.com", "/api/users", "20.0.0.1", 200, "api"},
+		{"shop.example.com", "/api", "20.0.0.1", 200, "shop2"},
+		{"www.example.com", "/apis", "20.0.0.1", 404, "404 page not found\n"},
+		{"other.org", "/blog/post", "20.0.0.1", 200, "blog"},
+		{"other.org", "/", "20.0.0.1", 404, "404 page not found\n"},
+	}
+	for _, c := range cases {
+		code, body := get(c.host, c.path, c.xff)
+		assert.Equal(t, c.code, code, c.host+c.path)
+		assert.Equal(t, c.body, body, c.host+c.path)
+	}
+
+	// Clients are cached per route
+	assert.NotNil(t, cache.Get(blt, "shop@20.0.0.1"))
+	assert.NotNil(t, cache.Get(blt, "api@20.0.0.1"))
+
+	// Unmatched requests are sent to default route
+	cmd.DefaultRoute = "blog"
+	proxy = cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{}))
+	code, body := get("other.org", "/", "20.0.0.1")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "blog", body)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerLimits(t *testing.T) {
+	defer func(readHeaderTimeout time.Duration, maxHeaderBytes int) {
+		cmd.ReadHeaderTimeout, cmd.MaxHeaderBytes = readHeaderTimeout, maxHeaderBytes
+	}(cmd.ReadHeaderTimeout, cmd.MaxHeaderBytes)
+	cmd.ReadHeaderTimeout, cmd.MaxHeaderBytes = 100*time.Millisecond, 1024
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := cmd.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}), nil)
+	go srv.Serve(cmd.LimitListener(ln, 1))
+	defer srv.Close()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err)
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+
+	// Client which doesn't finish headers in time is disconnected
+	c := dial()
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n"))
+	assert.Nil(t, err)
+	start := time.Now()
+	_, err = ioutil.ReadAll(c)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 4*time.Second)
+	c.Close()
+
+	// Too large headers are rejected
+	c = dial()
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nX-Big: " + strings.Repeat("a", 8192) + "\r\n\r\n"))
+	assert.Nil(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	c.Close()
+
+	// The second connection waits until the first one is closed
+	c1 := dial()
+	_, err = c1.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	assert.Nil(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(c1), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	c2 := dial()
+	defer c2.Close()
+	_, err = c2.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	assert.Nil(t, err)
+	c2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = c2.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	c1.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err = http.ReadResponse(bufio.NewReader(c2), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	defer func(upstreams []string, maxBodySize int64, routes []cmd.RouteConfig) {
+		cmd.Upstreams, cmd.MaxBodySize, cmd.RouteConfigs = upstreams, maxBodySize, routes
+	}(cmd.Upstreams, cmd.MaxBodySize, cmd.RouteConfigs)
+	cmd.Upstreams = []string{backend.URL}
+	cmd.MaxBodySize = 8
+	cmd.RouteConfigs = []cmd.RouteConfig{{Name: "upload", Path: "/upload", MaxBodySize: 16, Regions: []cmd.RegionConfig{{ID: 1, Pool: "1"}}}}
+	p := cmd.NewMultipleHostProxy(&cmd.Env{})
+	defer p.Close()
+	srv := httptest.NewServer(cmd.NewXffProxy(p))
+	defer srv.Close()
+
+	post := func(path string, body io.Reader) int {
+		resp, err := http.Post(srv.URL+path, "text/plain", body)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Declared and streamed bodies are limited, route overrides global limit
+	assert.Equal(t, 200, post("/", strings.NewReader("12345678")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("/", strings.NewReader("123456789")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("/", io.MultiReader(strings.NewReader("123456789"))))
+	assert.Equal(t, 200, post("/upload", strings.NewReader("1234567890123456")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("/upload", io.MultiReader(strings.NewReader("12345678901234567"))))
+}
@@ -1,5 +1,5 @@
 CREATE TABLE ip_to_region (
-  ip    varchar2(20) NOT NULL
+  ip    varchar2(45) NOT NULL
   ,region    number(10) NOT NULL
 );
 
@@ -25,3 +25,4 @@ INSERT INTO ip_to_region (ip, region) VALUES ('20.0.0.7', 2);
 INSERT INTO ip_to_region (ip, region) VALUES ('20.0.0.8', 2);
 INSERT INTO ip_to_region (ip, region) VALUES ('20.0.0.9', 2);
 
+INSERT INTO ip_to_region (ip, region) VALUES ('2001:db8::1', 2);
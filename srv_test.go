@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+// Minimal DNS server which answers every query with SRV records
+type srvServer struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	records []net.SRV
+}
+
+func newSRVServer(t *testing.T) *srvServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &srvServer{conn: conn}
+	go s.serve()
+	return s
+}
+
+func (s *srvServer) setRecords(records ...net.SRV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+}
+
+func (s *srvServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.conn.WriteTo(s.answer(buf[:n]), addr)
+	}
+}
+
+func (s *srvServer) answer(query []byte) []byte {
+	// Question section is the name followed by type and class
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := append([]byte{}, query[:2]...)
+	msg = append(msg, 0x81, 0x80, 0, 1, 0, byte(len(s.records)), 0, 0, 0, 0)
+	msg = append(msg, query[12:end]...)
+	for _, r := range s.records {
+		var target []byte
+		for _, label := range strings.Split(strings.TrimSuffix(r.Target, "."), ".") {
+			target = append(target, byte(len(label)))
+			target = append(target, label...)
+		}
+		target = append(target, 0)
+		// Name is a pointer to question, type SRV, class IN, TTL 1 second
+		msg = append(msg, 0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 1)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(6+len(target)))
+		msg = binary.BigEndian.AppendUint16(msg, r.Priority)
+		msg = binary.BigEndian.AppendUint16(msg, r.Weight)
+		msg = binary.BigEndian.AppendUint16(msg, r.Port)
+		msg = append(msg, target...)
+	}
+	return msg
+}
+
+func backendPort(b *httptest.Server) uint16 {
+	u, _ := url.Parse(b.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return uint16(port)
+}
+
+func TestSRVPool(t *testing.T) {
+	b1, b2 := newBackend("1"), newBackend("2")
+	defer b1.Close()
+	defer b2.Close()
+	port1, port2 := backendPort(b1), backendPort(b2)
+
+	dns := newSRVServer(t)
+	defer dns.conn.Close()
+	// The second upstream is a backup with lower priority
+	dns.setRecords(net.SRV{Target: "localhost.", Port: port1, Priority: 10, Weight: 5}, net.SRV{Target: "localhost.", Port: port2, Priority: 20, Weight: 5})
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, dnsServer string, srvInterval time.Duration) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs = upstreams, pools, regions
+		cmd.DNSServer, cmd.SRVInterval = dnsServer, srvInterval
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DNSServer, cmd.SRVInterval)
+	cmd.Upstreams = nil
+	cmd.DNSServer = dns.conn.LocalAddr().String()
+	cmd.SRVInterval = 50 * time.Millisecond
+	cmd.Pools = map[string]cmd.PoolConfig{"app": {SRV: "_http._tcp.app.test/base"}}
+	cmd.RegionConfigs = []cmd.RegionConfig{{ID: 1, Pool: "app"}}
+
+	blt, err := bolt.Open("/tmp/regiond-srv.db", 0600, nil)
+	assert.Nil(t, err)
+	defer func() {
+		blt.Close()
+		os.Remove("/tmp/regiond-srv.db")
+	}()
+	p := cmd.NewMultipleHostProxy(&cmd.Env{Blt: blt})
+	defer p.Close()
+	proxy := cmd.NewXffProxy(p)
+
+	get := func(i int) string {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, prepareRequest(t, "/", i))
+		body, _ := ioutil.ReadAll(w.Body)
+		return string(body) + w.Header().Get("X-Path")
+	}
+	for i := 1; i <= REQUESTS; i++ {
+		assert.Equal(t, "1/base/", get(i))
+	}
+
+	// Removed upstream is replaced for cached clients too
+	dns.setRecords(net.SRV{Target: "localhost.", Port: port2, Priority: 10, Weight: 5})
+	time.Sleep(200 * time.Millisecond)
+	for i := 1; i <= REQUESTS; i++ {
+		assert.Equal(t, "2/base/", get(i))
+	}
+}
+
+func TestSRVBackups(t *testing.T) {
+	down := map[string]*atomic.Bool{"primary": {}, "spare": {}, "backup": {}}
+	primary, spare := newHealthBackend("primary", down["primary"]), newHealthBackend("spare", down["spare"])
+	backup := newHealthBackend("backup", down["backup"])
+	defer primary.Close()
+	defer spare.Close()
+	defer backup.Close()
+	port1, port2, port3 := backendPort(primary), backendPort(spare), backendPort(backup)
+
+	dns := newSRVServer(t)
+	defer dns.conn.Close()
+	// Spare has zero weight next to weighted primary, backup has higher priority
+	dns.setRecords(
+		net.SRV{Target: "localhost.", Port: port1, Priority: 10, Weight: 5},
+		net.SRV{Target: "localhost.", Port: port2, Priority: 10, Weight: 0},
+		net.SRV{Target: "localhost.", Port: port3, Priority: 20, Weight: 0},
+	)
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, dnsServer string, srvInterval time.Duration, healthPath string, healthInterval, healthTimeout time.Duration, healthThreshold int) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs = upstreams, pools, regions
+		cmd.DNSServer, cmd.SRVInterval = dnsServer, srvInterval
+		cmd.HealthPath, cmd.HealthInterval, cmd.HealthTimeout, cmd.HealthThreshold = healthPath, healthInterval, healthTimeout, healthThreshold
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DNSServer, cmd.SRVInterval, cmd.HealthPath, cmd.HealthInterval, cmd.HealthTimeout, cmd.HealthThreshold)
+	cmd.Upstreams = nil
+	cmd.DNSServer = dns.conn.LocalAddr().String()
+	cmd.SRVInterval = time.Hour
+	cmd.Pools = map[string]cmd.PoolConfig{"app": {SRV: "_http._tcp.app.test"}}
+	cmd.RegionConfigs = []cmd.RegionConfig{{ID: 1, Pool: "app"}}
+	cmd.HealthPath, cmd.HealthInterval, cmd.HealthTimeout, cmd.HealthThreshold = "/health", 20*time.Millisecond, time.Second, 1
+	p := cmd.NewMultipleHostProxy(&cmd.Env{})
+	defer p.Close()
+	proxy := cmd.NewXffProxy(p)
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, prepareRequest(t, "/", 1))
+		return w.Body.String()
+	}
+	// Health is changed by checks in background
+	await := func(expected string) {
+		for i := 0; i < 200 && get() != expected; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, expected, get())
+	}
+	await("primary")
+
+	// Zero weight record is used when weighted one of the same priority is unhealthy,
+	// backup is used when all primaries are unhealthy
+	down["primary"].Store(true)
+	await("spare")
+	down["spare"].Store(true)
+	await("backup")
+	down["primary"].Store(false)
+	await("primary")
+}
+
+func TestPoolPickHonorsWeights(t *testing.T) {
+	u1, _ := url.Parse("http://server1:8080")
+	u2, _ := url.Parse("http://server2:8080")
+	u3, _ := url.Parse("http://server3:8080")
+	pool := cmd.NewPool("weighted", nil)
+	assert.Nil(t, pool.Pick())
+
+	pool.SetTargets([]*url.URL{u1, u2, u3}, []int{3, 1, 0})
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[pool.Pick().Host]++
+	}
+	assert.Zero(t, counts["server3:8080"])
+	assert.InDelta(t, 3000, counts["server1:8080"], 200)
+	assert.InDelta(t, 1000, counts["server2:8080"], 200)
+}
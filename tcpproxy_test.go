@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPProxy(t *testing.T) {
+	b1, b2 := newTCPBackend(t, "1"), newTCPBackend(t, "2")
+	defer b1.Close()
+	defer b2.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, drainTimeout time.Duration) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DrainTimeout = upstreams, pools, regions, drainTimeout
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.DrainTimeout)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"first":  {Upstreams: []string{b1.Addr().String()}},
+		"second": {Upstreams: []string{b2.Addr().String()}},
+	}
+	cmd.RegionConfigs = []cmd.RegionConfig{
+		{ID: 1, Pool: "first", CIDRs: []string{"10.0.0.0/8"}},
+		{ID: 2, Pool: "second", CIDRs: []string{"127.0.0.0/8"}},
+	}
+	cmd.DrainTimeout = time.Hour
+	p := cmd.NewTCPProxy(&cmd.Env{})
+	defer p.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(ln) }()
+
+	// Connection is routed by client address and data is spliced in both directions
+	c, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Write([]byte("hello"))
+	assert.Nil(t, err)
+	c.(*net.TCPConn).CloseWrite()
+	reply, err := ioutil.ReadAll(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "2:hello", string(reply))
+	c.Close()
+
+	stats := expvar.Get("tcp").(*expvar.Map)
+	for i := 0; i < 100 && stats.Get("bytes-out") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "1", stats.Get("region.2.connections").String())
+	assert.Equal(t, "5", stats.Get("bytes-in").String())
+	assert.Equal(t, "7", stats.Get("bytes-out").String())
+
+	// Open connections are closed by drain after shutdown
+	c, err = net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	greeting := make([]byte, 2)
+	_, err = io.ReadFull(c, greeting)
+	assert.Nil(t, err)
+	p.Shutdown()
+	assert.Nil(t, <-served)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p.Drain(ctx)
+	_, err = ioutil.ReadAll(c)
+	assert.Nil(t, err)
+}
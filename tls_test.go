@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSListenerSelectsCertificateBySNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regiond-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	writeTestCert(t, ca, filepath.Join(dir, "default"), "default.local")
+	writeTestCert(t, ca, filepath.Join(dir, "wildcard"), "*.example.local")
+
+	store, err := cmd.NewCertStore("", "", dir)
+	assert.Nil(t, err)
+	cfg, err := cmd.NewTLSConfig(store, "", "none")
+	assert.Nil(t, err)
+	addr := serveTLS(t, cfg)
+
+	assert.Equal(t, "*.example.local", peerCommonName(t, addr, "app.example.local", ca, nil))
+	assert.Equal(t, "default.local", peerCommonName(t, addr, "default.local", ca, nil))
+
+	// Replace certificate on disk, store must pick it up
+	_, err = store.Watch()
+	assert.Nil(t, err)
+	writeTestCert(t, ca, filepath.Join(dir, "wildcard"), "app.example.local")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && peerCommonName(t, addr, "app.example.local", ca, nil) != "app.example.local" {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, "app.example.local", peerCommonName(t, addr, "app.example.local", ca, nil))
+}
+
+func TestTLSListenerVerifiesClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regiond-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	writeTestCert(t, ca, filepath.Join(dir, "server"), "server.local")
+	writeTestCert(t, ca, filepath.Join(dir, "client"), "client.local")
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+
+	store, err := cmd.NewCertStore(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "")
+	assert.Nil(t, err)
+	cfg, err := cmd.NewTLSConfig(store, caFile, "")
+	assert.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	// Explicit 'none' policy contradicts client CA bundle
+	_, err = cmd.NewTLSConfig(store, caFile, "none")
+	assert.NotNil(t, err)
+	addr := serveTLS(t, cfg)
+
+	client, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	assert.Nil(t, err)
+
+	// HTTP/2 must be negotiated for client with certificate
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: ca.pool(), ServerName: "server.local", Certificates: []tls.Certificate{client}},
+		ForceAttemptHTTP2: true,
+	}
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + addr + "/")
+	assert.Nil(t, err)
+	if err == nil {
+		resp.Body.Close()
+		assert.Equal(t, 2, resp.ProtoMajor)
+	}
+
+	// Client without certificate must be rejected
+	tr = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool(), ServerName: "server.local"}}
+	_, err = (&http.Client{Transport: tr}).Get("https://" + addr + "/")
+	assert.NotNil(t, err)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "regiond test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// writeTestCert writes 'prefix.crt' and 'prefix.key' pair signed by CA.
+func writeTestCert(t *testing.T, ca *testCA, prefix string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	// Write key first, so certificate pair is never observed half-written on reload
+	assert.Nil(t, ioutil.WriteFile(prefix+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	assert.Nil(t, ioutil.WriteFile(prefix+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+}
+
+// serveTLS starts HTTPS server on random port and returns its address.
+func serveTLS(t *testing.T, cfg *tls.Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		TLSConfig: cfg,
+	}
+	go srv.ServeTLS(ln, "", "")
+	return ln.Addr().String()
+}
+
+// peerCommonName returns common name of the certificate presented by server for SNI name.
+func peerCommonName(t *testing.T, addr string, sni string, ca *testCA, certs []tls.Certificate) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: sni, RootCAs: ca.pool(), Certificates: certs})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
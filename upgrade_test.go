@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	b1, b2 := newWebSocketBackend("1"), newWebSocketBackend("2")
+	defer b1.Close()
+	defer b2.Close()
+
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig, balance string, upgradeIdleTimeout, drainTimeout time.Duration) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs = upstreams, pools, regions
+		cmd.Balance, cmd.UpgradeIdleTimeout, cmd.DrainTimeout = balance, upgradeIdleTimeout, drainTimeout
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs, cmd.Balance, cmd.UpgradeIdleTimeout, cmd.DrainTimeout)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{"main": {Upstreams: []string{b1.URL, b2.URL}}}
+	cmd.RegionConfigs = []cmd.RegionConfig{{ID: 1, Pool: "main"}}
+	cmd.Balance, cmd.UpgradeIdleTimeout, cmd.DrainTimeout = "least-conn", time.Hour, time.Hour
+	p := cmd.NewMultipleHostProxy(&cmd.Env{})
+	defer p.Close()
+	srv := httptest.NewServer(cmd.NewXffProxy(p))
+	defer srv.Close()
+
+	dial := func() (*websocket.Conn, string) {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/echo", "", srv.URL)
+		assert.Nil(t, err)
+		var name string
+		assert.Nil(t, websocket.Message.Receive(ws, &name))
+		return ws, name
+	}
+
+	// Messages are proxied in both directions
+	ws1, name1 := dial()
+	defer ws1.Close()
+	var reply string
+	assert.Nil(t, websocket.Message.Send(ws1, "hello"))
+	assert.Nil(t, websocket.Message.Receive(ws1, &reply))
+	assert.Equal(t, "hello", reply)
+
+	// Open connection counts toward least connection balancing
+	ws2, name2 := dial()
+	defer ws2.Close()
+	assert.NotEqual(t, name1, name2)
+	stats := expvar.Get("upstreams").(*expvar.Map)
+	assert.Equal(t, "1", stats.Get(strings.TrimPrefix(b1.URL, "http://")+".upgraded").String())
+	assert.Equal(t, "1", stats.Get(strings.TrimPrefix(b2.URL, "http://")+".upgraded").String())
+
+	// Connections are closed by drain when they don't finish in time
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	p.Drain(ctx)
+	ws1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.NotNil(t, websocket.Message.Receive(ws1, &reply))
+	ws2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.NotNil(t, websocket.Message.Receive(ws2, &reply))
+
+	// Idle connection is closed
+	cmd.UpgradeIdleTimeout = 100 * time.Millisecond
+	ws3, _ := dial()
+	defer ws3.Close()
+	ws3.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	assert.NotNil(t, websocket.Message.Receive(ws3, &reply))
+	assert.True(t, time.Since(start) < 4*time.Second)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyForwardsToHttpsUpstreamWithBasePath(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.EscapedPath() + "?" + req.URL.RawQuery))
+	}))
+	defer backend.Close()
+
+	ca, err := ioutil.TempFile("", "regiond-ca")
+	assert.Nil(t, err)
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	ca.Close()
+
+	defer func(upstreams []string) {
+		cmd.Upstreams = upstreams
+	}(cmd.Upstreams)
+	cmd.Upstreams = []string{backend.URL + "/base?ca=" + ca.Name() + "&server-name=example.com&v=1"}
+	proxy := cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{}))
+
+	req := prepareRequest(t, "/path?q=2", 1)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "/base/path?v=1&q=2", w.Body.String())
+
+	// Escaped slash is kept when joined with base path
+	req = prepareRequest(t, "/files/a%2Fb?x=1", 1)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, "/base/files/a%2Fb?v=1&x=1", w.Body.String())
+}
+
+func TestProxyForwardsToH2cUpstream(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(strconv.Itoa(req.ProtoMajor)))
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	defer func(upstreams []string) {
+		cmd.Upstreams = upstreams
+	}(cmd.Upstreams)
+	cmd.Upstreams = []string{"h2c://" + backend.Listener.Addr().String()}
+	proxy := cmd.NewXffProxy(cmd.NewMultipleHostProxy(&cmd.Env{}))
+
+	req := prepareRequest(t, "/", 1)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "2", w.Body.String())
+}
+
+func TestParseUpstream(t *testing.T) {
+	u, opts, err := cmd.ParseUpstream("host:8080", cmd.TransportOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://host:8080", u.String())
+	assert.False(t, opts.H2C)
+
+	u, opts, err = cmd.ParseUpstream("https://host/base?insecure=true&dial-timeout=2s", cmd.TransportOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://host/base", u.String())
+	assert.True(t, opts.Insecure)
+	assert.Equal(t, "2s", opts.DialTimeout.String())
+
+	_, _, err = cmd.ParseUpstream("ftp://host", cmd.TransportOptions{})
+	assert.NotNil(t, err)
+	_, _, err = cmd.ParseUpstream("https://host?dial-timeout=abc", cmd.TransportOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestConflictingUpstreamTransports(t *testing.T) {
+	defer func(upstreams []string, pools map[string]cmd.PoolConfig, regions []cmd.RegionConfig) {
+		cmd.Upstreams, cmd.Pools, cmd.RegionConfigs = upstreams, pools, regions
+	}(cmd.Upstreams, cmd.Pools, cmd.RegionConfigs)
+	cmd.Upstreams = nil
+	cmd.Pools = map[string]cmd.PoolConfig{
+		"a": {Upstreams: []string{"https://host:8443/a?insecure=true"}},
+		"b": {Upstreams: []string{"https://host:8443/b"}},
+	}
+	cmd.RegionConfigs = []cmd.RegionConfig{{ID: 1, Pool: "a"}, {ID: 2, Pool: "b"}}
+	// Upstreams of the same host share transport, so their options must be the same
+	_, err := cmd.NewRouting(&cmd.Env{})
+	assert.NotNil(t, err)
+
+	cmd.Pools["b"] = cmd.PoolConfig{Upstreams: []string{"https://host:8443/b?insecure=true"}}
+	r, err := cmd.NewRouting(&cmd.Env{})
+	assert.Nil(t, err)
+	r.Close()
+}
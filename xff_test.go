@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/dddpaul/regiond/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIPIsTakenFromTrustedProxies(t *testing.T) {
+	defer func(trusted []string, hops int) {
+		cmd.TrustedProxies, cmd.TrustedHops = trusted, hops
+	}(cmd.TrustedProxies, cmd.TrustedHops)
+	cmd.TrustedProxies = []string{"10.0.0.0/8", "35.191.0.0/16"}
+
+	cases := []struct {
+		hops       int
+		remoteAddr string
+		header     string
+		value      string
+		ip         string
+	}{
+		// Public load balancer in front of private proxy
+		{0, "10.0.0.1:4000", "X-Forwarded-For", "1.1.1.1, 20.0.0.1, 35.191.0.5", "20.0.0.1"},
+		// Untrusted peer can't spoof client address
+		{0, "30.0.0.1:4000", "X-Forwarded-For", "20.0.0.1", "30.0.0.1"},
+		{0, "10.0.0.1:4000", "Forwarded", `for=20.0.0.1;proto=https, for="[2001:db8::1]:4711"`, "2001:db8::1"},
+		// Obfuscated identifier stops the walk
+		{0, "10.0.0.1:4000", "Forwarded", "for=20.0.0.1, for=_hidden", "10.0.0.1"},
+		// Fixed number of proxies in front
+		{2, "10.0.0.1:4000", "X-Forwarded-For", "1.1.1.1, 20.0.0.1, 10.0.0.2", "20.0.0.1"},
+		{5, "10.0.0.1:4000", "X-Forwarded-For", "20.0.0.1", "20.0.0.1"},
+	}
+	for _, c := range cases {
+		cmd.TrustedHops = c.hops
+		var ip string
+		h := cmd.NewXffProxy(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ip = cmd.ClientIP(req)
+		}))
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Header.Set(c.header, c.value)
+		h.ServeHTTP(nil, req)
+		assert.Equal(t, c.ip, ip, c.value)
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	trusted, err := cmd.ParseNetworks([]string{"127.0.0.1"})
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	pln := &cmd.ProxyProtoListener{Listener: ln, Trusted: trusted}
+
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24")
+	v2 = append(v2, net.ParseIP("2001:db8::1").To16()...)
+	v2 = append(v2, net.ParseIP("2001:db8::2").To16()...)
+	v2 = binary.BigEndian.AppendUint16(v2, 4711)
+	v2 = binary.BigEndian.AppendUint16(v2, 80)
+
+	headers := map[string]string{
+		"PROXY TCP4 20.0.0.1 10.0.0.1 4000 80\r\n": "20.0.0.1:4000",
+		string(v2):          "[2001:db8::1]:4711",
+		"PROXY UNKNOWN\r\n": "127.0.0.1",
+	}
+	for header, addr := range headers {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err)
+		c.Write([]byte(header + "hello\n"))
+
+		s, err := pln.Accept()
+		assert.Nil(t, err)
+		if addr == "127.0.0.1" {
+			assert.Equal(t, addr, s.RemoteAddr().(*net.TCPAddr).IP.String())
+		} else {
+			assert.Equal(t, addr, s.RemoteAddr().String())
+		}
+		line, err := bufio.NewReader(s).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "hello\n", line)
+		s.Close()
+		c.Close()
+	}
+}